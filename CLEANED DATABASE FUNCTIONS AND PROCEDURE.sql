@@ -19,6 +19,7 @@ BEGIN
             u.user_id AS "userId",
             u.user_name AS "userName",
             u.email,
+            u.locale,
             ur.role_id AS "roleId"
         FROM
             state_manager.user_table u
@@ -35,6 +36,7 @@ BEGIN
             'userId', 0,
             'userName', '0',
             'email', '0',
+            'locale', 'id',
             'roleId', 0
         );
     END IF;
@@ -55,6 +57,9 @@ DECLARE
     temp_state_id INT;
     new_state_name VARCHAR;
     is_complete   BOOLEAN;
+    approval_count     INT;
+    required_approvals INT;
+    assigned_user_id   INT;
 BEGIN
     is_complete := false;
 
@@ -64,6 +69,42 @@ BEGIN
     FROM state_manager.request_table
     WHERE request_id = request_id_input;
 
+    -- Leaving SUBMITTED needs approvals from as many distinct approvers as the requirement type asks for.
+    IF temp_state_id = 1 THEN
+        CALL state_manager.assert_user_role(user_id_input, ARRAY[2, 3]);
+
+        INSERT INTO state_manager.approval_table(request_id, user_id, approval_comment)
+        VALUES (request_id_input, user_id_input, comment_input)
+        ON CONFLICT (request_id, user_id) DO NOTHING;
+
+        SELECT COUNT(*)
+        INTO approval_count
+        FROM state_manager.approval_table
+        WHERE request_id = request_id_input;
+
+        SELECT t.required_approvals
+        INTO required_approvals
+        FROM state_manager.request_table r
+        JOIN state_manager.requirement_type_table t ON r.requirement_type_id = t.requirement_type_id
+        WHERE r.request_id = request_id_input;
+
+        -- Stay in SUBMITTED until enough approvals are collected.
+        IF approval_count < required_approvals THEN
+            SELECT state_name
+            INTO new_state_name
+            FROM state_manager.state_name_table
+            WHERE state_name_id = temp_state_id;
+
+            RETURN json_build_object(
+                'stateName', new_state_name,
+                'stateId', temp_state_id,
+                'approvalPending', true,
+                'approvalCount', approval_count,
+                'requiredApprovals', required_approvals
+            );
+        END IF;
+    END IF;
+
     -- Prevent advancing beyond the final state.
     IF temp_state_id > 4 THEN
         RAISE EXCEPTION 'Upgrade failed: the limit has been reached';
@@ -93,13 +134,16 @@ BEGIN
     INSERT INTO state_manager.state_table(state_name_id, request_id, started_by, completed)
     VALUES(temp_state_id, request_id_input, user_id_input, is_complete);
 
+    -- Hand the request to an analyst if the new state has an assignment strategy.
+    assigned_user_id := state_manager.auto_assign_request(request_id_input);
+
     -- Retrieve the name of the new state for the response.
     SELECT state_name
     INTO new_state_name
     FROM state_manager.state_name_table
     WHERE state_name_id = temp_state_id;
 
-    RETURN json_build_object('stateName', new_state_name, 'stateId', temp_state_id);
+    RETURN json_build_object('stateName', new_state_name, 'stateId', temp_state_id, 'assigneeId', assigned_user_id);
 END;
 $$ LANGUAGE plpgsql;
 
@@ -113,6 +157,7 @@ CREATE OR REPLACE FUNCTION state_manager.degrade_state(
 DECLARE
     temp_state_id INT;
 	new_state_name VARCHAR;
+    assigned_user_id INT;
 BEGIN
     -- Decrement the state only if it's in a reversible stage.
     UPDATE state_manager.request_table
@@ -150,6 +195,9 @@ BEGIN
             ended_by = user_id_input
         WHERE request_id = request_id_input
           AND state_name_id = temp_state_id + 1;
+
+        -- Keep the analyst who did the work, only fill the slot if it is empty.
+        assigned_user_id := state_manager.auto_assign_request(request_id_input, true);
     ELSE
         RAISE EXCEPTION 'Degrade failed: unsupported state_id % for request_id %', temp_state_id, request_id_input;
     END IF;
@@ -160,7 +208,7 @@ BEGIN
     FROM state_manager.state_name_table
     WHERE state_name_id = temp_state_id;
 
-	RETURN json_build_object('stateName', new_state_name, 'stateId', temp_state_id);
+	RETURN json_build_object('stateName', new_state_name, 'stateId', temp_state_id, 'assigneeId', assigned_user_id);
 END;
 $$ LANGUAGE plpgsql;
 
@@ -201,7 +249,13 @@ END;
 $$ LANGUAGE plpgsql;
 
 
--- Creates a new request and its initial state, returning the new request ID.
+-- Creates a new request and its initial state, returning the new request ID and
+-- the user it was automatically assigned to, if any.
+-- source_request_id_input links a cloned request back to the request it was copied from.
+-- answers_input is a JSON object of requirement_question_id to answer.
+DROP FUNCTION IF EXISTS state_manager.create_new_request(VARCHAR, INTEGER, VARCHAR, TEXT, TIMESTAMP, VARCHAR, BOOLEAN, INTEGER, VARCHAR[], TEXT);
+DROP FUNCTION IF EXISTS state_manager.create_new_request(VARCHAR, INTEGER, VARCHAR, TEXT, TIMESTAMP, VARCHAR, BOOLEAN, INTEGER, VARCHAR[], TEXT, INTEGER);
+DROP FUNCTION IF EXISTS state_manager.create_new_request(VARCHAR, INTEGER, VARCHAR, TEXT, TIMESTAMP, VARCHAR, BOOLEAN, INTEGER, JSONB, TEXT, INTEGER);
 CREATE OR REPLACE FUNCTION state_manager.create_new_request(
     request_title_input          VARCHAR,
     user_id_input                INTEGER,
@@ -211,23 +265,25 @@ CREATE OR REPLACE FUNCTION state_manager.create_new_request(
     pic_submitter_input          VARCHAR,
     urgent_input                 BOOLEAN,
     requirement_type_input       INTEGER,
-    answers_input                VARCHAR[],
-    remark_input                 TEXT DEFAULT NULL
+    answers_input                JSONB,
+    remark_input                 TEXT DEFAULT NULL,
+    source_request_id_input      INTEGER DEFAULT NULL
 )
-RETURNS INTEGER AS $$
+RETURNS JSON AS $$
 DECLARE
-    temp_request_id INTEGER;
+    temp_request_id  INTEGER;
+    assigned_user_id INTEGER;
 BEGIN
     -- Insert the main request details and get the generated ID.
     INSERT INTO state_manager.request_table (
         request_title, user_id, requester_name, analysis_purpose,
         requested_completed_date, pic_submitter, urgent,
-        requirement_type_id, remark
+        requirement_type_id, remark, source_request_id
     )
     VALUES (
         request_title_input, user_id_input, requester_name_input, analysis_purpose_input,
         requested_completed_date_input, pic_submitter_input, urgent_input,
-        requirement_type_input, remark_input
+        requirement_type_input, remark_input, source_request_id_input
     )
     RETURNING request_id INTO temp_request_id;
 
@@ -238,42 +294,55 @@ BEGIN
     -- Store the associated answers using a separate procedure.
     CALL state_manager.store_answers(temp_request_id, requirement_type_input, answers_input);
 
-    RETURN temp_request_id;
+    -- Hand the request to an analyst if SUBMITTED has an assignment strategy.
+    assigned_user_id := state_manager.auto_assign_request(temp_request_id);
+
+    RETURN json_build_object('requestId', temp_request_id, 'assigneeId', assigned_user_id);
 END;
 $$ LANGUAGE plpgsql;
 
 
--- Stores an array of answers for a given request.
+-- Stores the answers of a given request, a JSON object of requirement_question_id to answer.
+-- The request is tied to the current questionnaire version of its requirement type,
+-- so it keeps showing the questions it was answered against after later edits.
+DROP PROCEDURE IF EXISTS state_manager.store_answers(INT, INT, VARCHAR[]);
 CREATE OR REPLACE PROCEDURE state_manager.store_answers(
     request_id_input          INT,
     requirement_type_id_input INT,
-    answer                    VARCHAR[]
+    answers_input             JSONB
 )
 AS $$
 DECLARE
-    question_num INT;
-    i            INT;
+    version_id INT;
 BEGIN
-    -- Determine how many questions need answers for this requirement type.
-    SELECT COUNT(*)
-    INTO question_num
-    FROM state_manager.requirement_question_table
+    SELECT current_version_id
+    INTO version_id
+    FROM state_manager.requirement_type_table
     WHERE requirement_type_id = requirement_type_id_input;
 
-    -- Loop through the answers array and insert each one.
-    -- Assumes the array index corresponds to the question number.
-    FOR i IN 1..question_num LOOP
-        INSERT INTO state_manager.requirement_table(request_id, requirement_question_id, answer)
-        VALUES (request_id_input, (requirement_type_id_input * 100 + i), answer[i]);
-    END LOOP;
+    UPDATE state_manager.request_table
+    SET questionnaire_version_id = version_id
+    WHERE request_id = request_id_input;
+
+    -- Insert one answer row per question of the version, in a single statement so the
+    -- search document is rebuilt once. Missing and empty answers, such as those of hidden
+    -- questions, are stored as NULL.
+    INSERT INTO state_manager.requirement_table(request_id, requirement_question_id, answer)
+    SELECT request_id_input, q.requirement_question_id, NULLIF(answers_input ->> q.requirement_question_id::TEXT, '')
+    FROM state_manager.requirement_question_table q
+    WHERE q.questionnaire_version_id = version_id
+    ORDER BY q.position;
 END;
 $$ LANGUAGE plpgsql;
 
 
 
 -- Fetches all questions for a requirement type as a JSON array.
+-- Without a questionnaire version the current questionnaire of the type is returned.
+DROP FUNCTION IF EXISTS state_manager.get_questions(INT);
 CREATE OR REPLACE FUNCTION state_manager.get_questions(
-    requirement_type_id_input INT
+    requirement_type_id_input      INT,
+    questionnaire_version_id_input INT DEFAULT NULL
 )
 RETURNS JSON AS $$
 DECLARE
@@ -285,11 +354,20 @@ BEGIN
     FROM (
         SELECT
             requirement_question_id AS "requirementQuestionId",
-            requirement_question AS "requirementQuestion"
-        FROM state_manager.requirement_question_table
-        -- Filter questions based on a naming convention (e.g., type 1 has IDs 101-199).
-        WHERE requirement_question_id BETWEEN (requirement_type_id_input * 100 + 1) AND (requirement_type_id_input * 100 + 99)
-        ORDER BY requirement_question_id
+            requirement_question AS "requirementQuestion",
+            question_type AS "questionType",
+            required,
+            min_value AS "minValue",
+            max_value AS "maxValue",
+            pattern,
+            options,
+            visible_when AS "visibleWhen",
+            required_when AS "requiredWhen"
+        FROM state_manager.requirement_question_table q
+        JOIN state_manager.requirement_type_table rt
+            ON q.questionnaire_version_id = COALESCE(questionnaire_version_id_input, rt.current_version_id)
+        WHERE rt.requirement_type_id = requirement_type_id_input
+        ORDER BY q.position
     ) t;
 
     -- Return an empty JSON array if no results are found.
@@ -361,43 +439,13 @@ BEGIN
         RETURN result_json;
     END IF;
 
-    -- Aggregate detailed request data into a single JSON array.
-    SELECT json_agg(row_to_json(t))
-    INTO result_json
-    FROM (
-        SELECT
-            r.request_id AS "requestId", 
-            r.request_title AS "requestTitle", 
-            r.current_state AS "currentState", 
-            r.request_date AS "requestDate",
-			rt.data_type_name AS "dataTypeName",
-            n2.state_name AS "currentStateName", 
-            u.user_name AS "userName", 
-            n.state_name AS "stateName",
-            n.state_name_id AS "stateNameId", 
-            s.date_start AS "dateStart", 
-            s.date_end AS "dateEnd", 
-            u2.user_name AS "startedBy",
-            u3.user_name AS "endedBy", 
-            s.completed
-        FROM state_manager.request_table r
-        JOIN state_manager.state_table s ON r.request_id = s.request_id
-        JOIN state_manager.user_table u ON r.user_id = u.user_id
-        LEFT JOIN state_manager.user_table u2 ON s.started_by = u2.user_id
-        LEFT JOIN state_manager.user_table u3 ON s.ended_by = u3.user_id
-        LEFT JOIN state_manager.state_name_table n ON s.state_name_id = n.state_name_id
-        LEFT JOIN state_manager.state_name_table n2 ON r.current_state = n2.state_name_id
-		LEFT JOIN state_manager.requirement_type_table rt ON r.requirement_type_id = rt.requirement_type_id
-		WHERE r.request_date BETWEEN start_date AND end_date
-          AND s.state_name_id = state_name_id_input
-		  AND r.current_state != 0
-        ORDER BY r.current_state, r.request_id
-    ) t;
-
-	-- Return an empty JSON array if no results are found.
-	IF result_json IS NULL THEN 
-		result_json := '[]'::json;
-	END IF;
+    -- Preset of list_requests: requests that entered the state, apart from rejected ones.
+    SELECT state_manager.list_requests(
+        NULL, (SELECT array_agg(state_name_id) FROM state_manager.state_name_table WHERE state_name_id <> 0),
+        state_name_id_input, NULL, NULL, NULL, NULL, start_date, end_date, NULL,
+        'STATE', FALSE, NULL, NULL, NULL
+    ) -> 'items'
+    INTO result_json;
     RETURN result_json;
 END;
 $$ LANGUAGE plpgsql;
@@ -412,44 +460,12 @@ RETURNS JSON AS $$
 DECLARE
     result_json JSON;
 BEGIN
-    -- Aggregate data for all active requests into a single JSON array.
-    SELECT json_agg(row_to_json(t))
-    INTO result_json
-    FROM (
-        SELECT
-            r.request_id AS "requestId", 
-            r.request_title AS "requestTitle", 
-            r.current_state AS "currentState", 
-            r.request_date AS "requestDate",
-			rt.data_type_name AS "dataTypeName",
-            n2.state_name AS "currentStateName", 
-            u.user_name AS "userName", 
-            n.state_name AS "stateName",
-            n.state_name_id AS "stateNameId", 
-            s.date_start AS "dateStart", 
-            s.date_end AS "dateEnd", 
-            u2.user_name AS "startedBy",
-            u3.user_name AS "endedBy", 
-            s.completed
-        FROM state_manager.request_table r
-        JOIN state_manager.state_table s ON r.request_id = s.request_id
-        JOIN state_manager.user_table u ON r.user_id = u.user_id
-        LEFT JOIN state_manager.user_table u2 ON s.started_by = u2.user_id
-        LEFT JOIN state_manager.user_table u3 ON s.ended_by = u3.user_id
-        LEFT JOIN state_manager.state_name_table n ON s.state_name_id = n.state_name_id
-        LEFT JOIN state_manager.state_name_table n2 ON r.current_state = n2.state_name_id
-        LEFT JOIN state_manager.requirement_type_table rt ON r.requirement_type_id = rt.requirement_type_id
-		WHERE r.request_date BETWEEN start_date AND end_date
-          -- This condition ensures we only get the current, active state for each request.
-          AND s.state_name_id = r.current_state
-          AND s.state_name_id = ANY(ARRAY[1, 2, 3, 4, 5])
-        ORDER BY r.current_state, r.request_id
-    ) t;
-
-	-- Return an empty JSON array if no results are found.
-	IF result_json IS NULL THEN 
-		result_json := '[]'::json;
-	END IF;
+    -- Preset of list_requests: the current state of every active request.
+    SELECT state_manager.list_requests(
+        NULL, ARRAY[1, 2, 3, 4, 5], NULL, NULL, NULL, NULL, NULL, start_date, end_date, NULL,
+        'STATE', FALSE, NULL, NULL, NULL
+    ) -> 'items'
+    INTO result_json;
     RETURN result_json;
 END;
 $$ LANGUAGE plpgsql;
@@ -463,28 +479,12 @@ RETURNS JSON AS $$
 DECLARE
     result_json JSON;
 BEGIN
-    -- Aggregate request summaries into a single JSON array.
-    SELECT json_agg(row_to_json(t))
-    INTO result_json
-    FROM (
-        SELECT
-            r.request_id AS "requestId", 
-            r.request_title AS "requestTitle", 
-            r.request_date AS "requestDate",
-            rt.data_type_name AS "dataTypeName", 
-            n.state_name AS "stateName", 
-            n.state_name_id AS "stateNameId"
-        FROM state_manager.request_table r
-        JOIN state_manager.state_name_table n ON r.current_state = n.state_name_id
-        JOIN state_manager.requirement_type_table rt ON r.requirement_type_id = rt.requirement_type_id
-        WHERE r.user_id = user_id_input
-        ORDER BY n.state_name_id,r.request_id
-    ) t;
-
-    -- Return an empty JSON array if no results are found.
-    IF result_json IS NULL THEN
-		result_json := '[]'::json;
-	END IF;
+    -- Preset of list_requests: every request of the user, by state.
+    SELECT state_manager.list_requests(
+        NULL, NULL, NULL, NULL, user_id_input, NULL, NULL, NULL, NULL, NULL,
+        'STATE', FALSE, NULL, NULL, NULL
+    ) -> 'items'
+    INTO result_json;
     RETURN result_json;
 END;
 $$ LANGUAGE plpgsql;
@@ -535,44 +535,28 @@ BEGIN
     ELSIF user_role_input = 3 THEN viewable := ARRAY[1,2,3,4,5];
     END IF;
 
-    -- Aggregate actionable requests into a single JSON array.
-    SELECT json_agg(row_to_json(t))
-    INTO result_json
-    FROM (
-        SELECT
-            r.request_id AS "requestId", 
-            r.request_title AS "requestTitle", 
-            r.request_date AS "requestDate", 
-            rt.requirement_type_id AS "requirementTypeId",
-            rt.data_type_name AS "dataTypeName", 
-            u.user_name AS "userName", 
-            n.state_name_id AS "stateNameId", 
-            n.state_name AS "stateName",
-            s.date_start AS "dateStart", 
-            s.state_comment AS "stateComment"
-        FROM state_manager.request_table r
-        JOIN state_manager.user_table u ON r.user_id = u.user_id
-        JOIN state_manager.state_table s ON r.request_id = s.request_id
-        JOIN state_manager.state_name_table n ON r.current_state = n.state_name_id
-        JOIN state_manager.requirement_type_table rt ON r.requirement_type_id = rt.requirement_type_id
-        WHERE s.state_name_id = ANY(viewable)
-          -- Ensures we only get the current, active state.
-          AND s.state_name_id = r.current_state
-        ORDER BY s.state_name_id ASC, rt.requirement_type_id, r.request_id
-    ) t;
+    -- Return an empty JSON array for roles without actionable states.
+    IF viewable IS NULL THEN
+        RETURN '[]'::json;
+    END IF;
 
-    -- Return an empty JSON array if no results are found.
-    IF result_json IS NULL THEN
-		result_json := '[]'::json;
-	END IF;
+    -- Preset of list_requests: requests currently in an actionable state, by state.
+    SELECT state_manager.list_requests(
+        NULL, viewable, NULL, NULL, NULL, NULL, NULL, NULL, NULL, NULL,
+        'STATE', FALSE, NULL, NULL, NULL
+    ) -> 'items'
+    INTO result_json;
     RETURN result_json;
 END;
 $$ LANGUAGE plpgsql;
 
 
 -- Retrieves all details for a single request, bundling related items into JSON arrays.
+-- The viewer decides whether internal comments are included.
+DROP FUNCTION IF EXISTS state_manager.get_complete_data_of_request_bundle(INT);
 CREATE OR REPLACE FUNCTION state_manager.get_complete_data_of_request_bundle(
-    request_id_input INT
+    request_id_input INT,
+    viewer_id_input  INT DEFAULT NULL
 )
 RETURNS JSON AS $$
 DECLARE
@@ -592,9 +576,16 @@ BEGIN
             r.urgent,
             r.request_date AS "requestDate",
             r.remark,
+            r.source_request_id AS "sourceRequestId",
             s.state_comment AS "stateComment",
             n.state_name AS "stateName",
+            r.requirement_type_id AS "requirementTypeId",
+            r.questionnaire_version_id AS "questionnaireVersionId",
             t.data_type_name AS "dataTypeName",
+            r.assignee_id AS "assigneeId",
+            ua.user_name AS "assigneeName",
+            r.reviewer_id AS "reviewerId",
+            ur.user_name AS "reviewerName",
 
             -- Subquery aggregates all related questions and answers into a nested JSON array.
             (
@@ -607,7 +598,7 @@ BEGIN
                     FROM state_manager.requirement_table re
                     JOIN state_manager.requirement_question_table q ON re.requirement_question_id = q.requirement_question_id
                     WHERE re.request_id = r.request_id
-                    ORDER BY re.requirement_question_id
+                    ORDER BY q.position, re.requirement_question_id
                 ) AS reqs
             ) AS "questions",
 
@@ -621,12 +612,41 @@ BEGIN
                     FROM state_manager.attachment_table att
                     WHERE att.request_id = r.request_id
                 ) AS files
-            ) AS "filenames"
+            ) AS "filenames",
+
+            -- Subquery aggregates the approvals collected while the request was SUBMITTED.
+            t.required_approvals AS "requiredApprovals",
+            (
+                SELECT COALESCE(json_agg(apps), '[]'::json)
+                FROM (
+                    SELECT
+                        a.user_id AS "userId",
+                        ua2.user_name AS "userName",
+                        a.approved_at AS "approvedAt",
+                        a.approval_comment AS "approvalComment"
+                    FROM state_manager.approval_table a
+                    JOIN state_manager.user_table ua2 ON a.user_id = ua2.user_id
+                    WHERE a.request_id = r.request_id
+                    ORDER BY a.approved_at
+                ) AS apps
+            ) AS "approvals",
+
+            -- The comment thread, without internal comments unless the viewer is staff.
+            state_manager.get_request_comments(r.request_id, viewer_id_input) AS "comments",
+
+            -- Field-level edit history made by the requester, only shown to staff.
+            CASE
+                WHEN viewer_id_input IS NOT NULL AND state_manager.is_staff(viewer_id_input)
+                THEN state_manager.get_request_changes(r.request_id)
+                ELSE '[]'::json
+            END AS "changeHistory"
 
         FROM state_manager.request_table r
         JOIN state_manager.state_table s ON r.request_id = s.request_id AND r.current_state = s.state_name_id
         JOIN state_manager.state_name_table n ON r.current_state = n.state_name_id
         JOIN state_manager.requirement_type_table t ON r.requirement_type_id = t.requirement_type_id
+        LEFT JOIN state_manager.user_table ua ON r.assignee_id = ua.user_id
+        LEFT JOIN state_manager.user_table ur ON r.reviewer_id = ur.user_id
         WHERE r.request_id = request_id_input
     ) t;
 
@@ -652,8 +672,10 @@ BEGIN
     INTO result_json
     FROM (
         SELECT
+            u.user_id AS "userId",
             u.user_name AS "userName", 
-            u.email
+            u.email,
+            u.locale
         FROM state_manager.user_role_table ur
         JOIN state_manager.user_table u ON ur.user_id = u.user_id
         WHERE ur.role_id = role_id_input
@@ -682,7 +704,8 @@ BEGIN
     FROM (
         SELECT
             user_name AS "userName", 
-            email
+            email,
+            locale
         FROM state_manager.user_table
         WHERE user_id = user_id_input
     ) t;
@@ -786,6 +809,9 @@ BEGIN
             requirement_type_id AS "requirementTypeId",
             data_type_name AS "dataTypeName"
         FROM state_manager.requirement_type_table
+        -- Inactive types are kept for their existing requests but not offered for new ones.
+        WHERE active
+        ORDER BY requirement_type_id
     ) t;
 
     -- Return an empty JSON array if no results are found.
@@ -797,114 +823,4787 @@ END;
 $$ LANGUAGE plpgsql;
 
 
--- TEST TO GET USER ID FROM CREDENTIAL CHECK
-SELECT get_user_id_by_credentials('Alto', '1234')
+-- Adds per-user assignment to requests on top of the role based routing.
+-- The assignee works on the request, the optional reviewer checks the result.
+ALTER TABLE state_manager.request_table
+    ADD COLUMN IF NOT EXISTS assignee_id INT REFERENCES state_manager.user_table(user_id),
+    ADD COLUMN IF NOT EXISTS reviewer_id INT REFERENCES state_manager.user_table(user_id);
 
--- CLEAR DATA WITHIN TABLE
-TRUNCATE TABLE state_table, requirement_table, attachment_table, request_table, user_role_table, user_table RESTART IDENTITY;
 
-TRUNCATE TABLE user_table;
+-- Raises an exception if the user does not hold one of the given roles.
+CREATE OR REPLACE PROCEDURE state_manager.assert_user_role(
+    user_id_input INT,
+    role_ids      INT[]
+) AS $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1
+        FROM state_manager.user_role_table
+        WHERE user_id = user_id_input
+          AND role_id = ANY(role_ids)
+    ) THEN
+        RAISE EXCEPTION 'Permission denied: user % does not have a required role', user_id_input;
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
 
--- TRUNCATE TABLE requirement_type_table;
--- TRUNCATE TABLE requirement_question_table;
 
--- INSERT MAPPING OF STATE NAME AND ID
-INSERT INTO state_name_table (state_name_id, state_name)
-VALUES
-(0, 'REJECTED'),
-(1, 'SUBMITTED'),
-(2, 'VALIDATED'),
-(3, 'IN PROGRESS'),
-(4, 'WAITING FOR REVIEW'),
-(5, 'DONE'),
-(41, 'APPROVAL REJECTED');
+-- Returns the assignment details of a request as a JSON object.
+CREATE OR REPLACE FUNCTION state_manager.get_request_assignment(
+    request_id_input INT
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    SELECT row_to_json(t)
+    INTO result_json
+    FROM (
+        SELECT
+            r.request_id AS "requestId",
+            r.request_title AS "requestTitle",
+            n.state_name AS "stateName",
+            r.assignee_id AS "assigneeId",
+            ua.user_name AS "assigneeName",
+            ua.email AS "assigneeEmail",
+            ua.locale AS "assigneeLocale",
+            r.reviewer_id AS "reviewerId",
+            ur.user_name AS "reviewerName"
+        FROM state_manager.request_table r
+        JOIN state_manager.state_name_table n ON r.current_state = n.state_name_id
+        LEFT JOIN state_manager.user_table ua ON r.assignee_id = ua.user_id
+        LEFT JOIN state_manager.user_table ur ON r.reviewer_id = ur.user_id
+        WHERE r.request_id = request_id_input
+    ) t;
 
--- INSERT ROLE DATA
-INSERT INTO role_table (role_id, role_name)
-VALUES 
-(1, 'user'),
-(2, 'worker'),
-(3, 'validator')
+    -- Return an empty JSON object if no request is found.
+    IF result_json IS NULL THEN
+        result_json := '{}'::json;
+    END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
 
--- INSERT DUMMY USER ROLE
-INSERT INTO user_role_table (user_id, role_id) VALUES
-(1, 1),
-(2, 1),
-(3, 1),
-(4, 1),
-(5, 1),
-(6, 1),
-(7, 2),
-(8, 2),
-(9, 3),
-(10, 3),
-(11, 3);
 
--- INSERT DUMMY USER
-INSERT INTO state_manager.user_table (user_id, user_name, user_password, email, nik, position, department) VALUES
--- ('1', 'alice',   '1234', 'alice@example.com',   1001, 'Manager',      'HR'),
-('2', 'ivan',    '1234', 'ivan@example.com',    1009, 'Supervisor',   'IT'),
-('3', 'grace',   '1234', 'grace@example.com',   1007, 'Manager',      'Marketing');
-,
--- ('heidi',   '1234', 2, 'heidi@example.com',   1008, 'Staff',        'Marketing'),
--- ('judy',    '1234', 1, 'judy@example.com',    1010, 'Manager',      'Finance')
--- ('bob',     '1234', 2, 'bob@example.com',     1002, 'Staff',        'Finance'),
--- ('carol',   '1234', 3, 'carol@example.com',   1003, 'Supervisor',   'IT'),
--- ('dave',    '1234', 1, 'dave@example.com',    1004, 'Manager',      'IT'),
--- ('eve',     '1234', 2, 'eve@example.com',     1005, 'Staff',        'HR'),
--- ('frank',   '1234', 3, 'frank@example.com',   1006, 'Supervisor',   'Finance'),;
+-- Assigns an unassigned request to the calling worker or validator.
+CREATE OR REPLACE FUNCTION state_manager.claim_request(
+    request_id_input INT,
+    user_id_input    INT
+)
+RETURNS JSON AS $$
+BEGIN
+    CALL state_manager.assert_user_role(user_id_input, ARRAY[2, 3]);
 
-INSERT INTO user_table (user_name, user_password, user_role, email, nik, position, department) VALUES
-('barta',    '1234', 1, 'barta@example.com',    1011, 'Manager',      'Finance');
+    -- Only claim the request if nobody else holds it yet.
+    UPDATE state_manager.request_table
+    SET assignee_id = user_id_input
+    WHERE request_id = request_id_input
+      AND current_state = ANY(ARRAY[1, 2, 3, 4])
+      AND (assignee_id IS NULL OR assignee_id = user_id_input);
 
--- insert dummy request
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Claim failed: request % is closed or already assigned', request_id_input;
+    END IF;
 
-CALL create_new_request('Sales Report Q1', 1, 'alice', 'Analyze Q1 sales trends, focusing on regional performance.', '2025-01-20 17:00:00', 'alice', false, 1,
-ARRAY['CRM System A', 'Last Quarter', 'Revenue per Region'], 'Initial sales overview request');
-CALL create_new_request('Inventory Audit', 2, 'bob', 'Check inventory discrepancies across warehouses, needing specific new columns.', '2025-02-15 17:00:00', 'bob', true, 2,
-ARRAY['Warehouse Logs', 'Item_Quantity, Bin_Location', 'LIFO Method', 'false'], 'Urgent audit, data needed by end of week');
-CALL create_new_request('Customer Feedback', 3, 'carol', 'Summarize customer feedback from surveys and support tickets.', '2025-03-10 17:00:00', 'carol', false, 3,
-ARRAY['User Behavior Module', 'Website Analytics DB', 'Last 30 Days', 'Clickstream Analysis', 'Product Team', 'Heatmap Report'], 'Needs to be presented at quarterly review');
-CALL create_new_request('IT Upgrade', 4, 'dave', 'Plan for new hardware rollout in Q3.', '2025-03-25 17:00:00', 'dave', true, 1,
-ARRAY['Network Logs', 'Current Year', 'Bandwidth Usage'], 'High priority, budget allocation pending');
-CALL create_new_request('HR Survey', 5, 'eve', 'Analyze employee satisfaction scores from recent survey.', '2025-04-10 17:00:00', 'eve', false, 2,
-ARRAY['Employee Records DB', 'Job_Satisfaction_Index, Turnover_Rate', 'Standard Deviation', 'true'], 'Annual survey results analysis');
-CALL create_new_request('Budget Review', 6, 'frank', 'Review Q2 budget allocations and spending patterns.', '2025-04-30 17:00:00', 'frank', false, 3,
-ARRAY['Expense Tracking System', 'Financial GL', 'Q2 Current', 'Cost Center Allocation', 'Accounting Department', 'Expense Summary Report'], 'Prepare for monthly finance meeting');
-CALL create_new_request('Marketing Plan', 7, 'grace', 'Draft new marketing strategy for product launch.', '2025-05-15 17:00:00', 'grace', true, 1,
-ARRAY['Competitor Analysis', 'Next Quarter', 'Market Penetration'], 'Launch critical, needs quick turnaround');
-CALL create_new_request('Security Audit', 8, 'heidi', 'Assess system vulnerabilities and compliance.', '2025-05-28 17:00:00', 'heidi', false, 2,
-ARRAY['Vulnerability Scanner', 'Scan_Result_ID, Critical_Vulnerability_Count', 'CVSS Score', 'false'], 'Annual security review');
-CALL create_new_request('Supplier Evaluation', 9, 'ivan', 'Evaluate new suppliers for cost efficiency and quality.', '2025-06-11 17:00:00', 'ivan', true, 3,
-ARRAY['Vendor Portal', 'Contract Database', 'All Time', 'Quality Metrics', 'Purchasing Team', 'Supplier Risk Matrix'], 'Urgent to onboard new vendors');
-CALL create_new_request('Website Redesign', 10, 'judy', 'Plan new website layout and user experience improvements.', '2025-06-25 17:00:00', 'judy', false, 1,
-ARRAY['A/B Test Results', 'Current Version', 'Conversion Rate'], 'Enhance user engagement');
-CALL create_new_request('Inventory Audit (Q2)', 1, 'alice', 'Check inventory discrepancies for Q2 report.', '2025-02-15 17:00:00', 'alice', true, 2,
-ARRAY['Physical Count Sheet', 'Damaged_Items, Expired_Goods', 'Weighted Average', 'true'], 'Follow-up audit, Q2 data');
+    RETURN state_manager.get_request_assignment(request_id_input);
+END;
+$$ LANGUAGE plpgsql;
 
--- SET RANDOM MONTH
--- UPDATE request_table
--- SET
---     request_date = (
---         -- Take the year from the original date
---         EXTRACT(YEAR FROM request_date) || '-' ||
---         -- Generate a random month (1-6) and format it with leading zero if needed
---         LPAD(((FLOOR(RANDOM() * 6) + 1)::TEXT), 2, '0') || '-' ||
---         -- Take the day from the original date and format it with leading zero if needed
---         LPAD(EXTRACT(DAY FROM request_date)::TEXT, 2, '0') ||
---         -- Append the time component from the original date
---         TO_CHAR(request_date, ' HH24:MI:SS.MS')
---     )::TIMESTAMP
--- WHERE
---     request_id BETWEEN 2 AND 10;
 
-UPDATE state_table
-SET date_start = request_table.request_date
-FROM request_table
-WHERE state_table.request_id = request_table.request_id
-  AND state_table.state_name_id = 1;
+-- Releases a request held by the calling user so someone else can claim it.
+CREATE OR REPLACE FUNCTION state_manager.unclaim_request(
+    request_id_input INT,
+    user_id_input    INT
+)
+RETURNS JSON AS $$
+BEGIN
+    UPDATE state_manager.request_table
+    SET assignee_id = NULL
+    WHERE request_id = request_id_input
+      AND assignee_id = user_id_input;
 
--- INSERT REQUIREMENT QUESTIONS
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Unclaim failed: request % is not assigned to user %', request_id_input, user_id_input;
+    END IF;
+
+    RETURN state_manager.get_request_assignment(request_id_input);
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Moves a request to another worker or validator, optionally setting a reviewer.
+CREATE OR REPLACE FUNCTION state_manager.reassign_request(
+    request_id_input  INT,
+    user_id_input     INT,
+    assignee_id_input INT,
+    reviewer_id_input INT DEFAULT NULL
+)
+RETURNS JSON AS $$
+BEGIN
+    -- Both the caller and the new assignee must be able to work on requests.
+    CALL state_manager.assert_user_role(user_id_input, ARRAY[2, 3]);
+    CALL state_manager.assert_user_role(assignee_id_input, ARRAY[2, 3]);
+    IF reviewer_id_input IS NOT NULL THEN
+        CALL state_manager.assert_user_role(reviewer_id_input, ARRAY[2, 3]);
+    END IF;
+
+    UPDATE state_manager.request_table
+    SET assignee_id = assignee_id_input,
+        reviewer_id = COALESCE(reviewer_id_input, reviewer_id)
+    WHERE request_id = request_id_input
+      AND current_state = ANY(ARRAY[1, 2, 3, 4]);
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Reassign failed: request % is closed or does not exist', request_id_input;
+    END IF;
+
+    RETURN state_manager.get_request_assignment(request_id_input);
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Fetches a "to-do" list of the active requests assigned to, or reviewed by, a specific user.
+CREATE OR REPLACE FUNCTION state_manager.get_assigned_todo_data(
+    user_id_input INT
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    -- Aggregate the user's requests into a single JSON array.
+    SELECT json_agg(row_to_json(t))
+    INTO result_json
+    FROM (
+        SELECT
+            r.request_id AS "requestId", 
+            r.request_title AS "requestTitle", 
+            r.request_date AS "requestDate", 
+            rt.requirement_type_id AS "requirementTypeId",
+            rt.data_type_name AS "dataTypeName", 
+            u.user_name AS "userName", 
+            n.state_name_id AS "stateNameId", 
+            n.state_name AS "stateName",
+            s.date_start AS "dateStart", 
+            s.state_comment AS "stateComment",
+            r.assignee_id AS "assigneeId",
+            ua.user_name AS "assigneeName"
+        FROM state_manager.request_table r
+        JOIN state_manager.user_table u ON r.user_id = u.user_id
+        JOIN state_manager.state_table s ON r.request_id = s.request_id
+        JOIN state_manager.state_name_table n ON r.current_state = n.state_name_id
+        JOIN state_manager.requirement_type_table rt ON r.requirement_type_id = rt.requirement_type_id
+        LEFT JOIN state_manager.user_table ua ON r.assignee_id = ua.user_id
+        WHERE (r.assignee_id = user_id_input OR r.reviewer_id = user_id_input)
+          AND r.current_state = ANY(ARRAY[1, 2, 3, 4])
+          -- Ensures we only get the current, active state.
+          AND s.state_name_id = r.current_state
+        ORDER BY s.state_name_id ASC, rt.requirement_type_id, r.request_id
+    ) t;
+
+    -- Return an empty JSON array if no results are found.
+    IF result_json IS NULL THEN
+		result_json := '[]'::json;
+	END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Lets admins take analysts out of the automatic assignment pool (e.g. on leave).
+ALTER TABLE state_manager.user_table
+    ADD COLUMN IF NOT EXISTS available BOOLEAN NOT NULL DEFAULT TRUE;
+
+-- Requirement types an analyst is skilled in, used by the SKILL_BASED strategy.
+CREATE TABLE IF NOT EXISTS state_manager.analyst_skill_table (
+    user_id             INT NOT NULL REFERENCES state_manager.user_table(user_id),
+    requirement_type_id INT NOT NULL REFERENCES state_manager.requirement_type_table(requirement_type_id),
+    PRIMARY KEY (user_id, requirement_type_id)
+);
+
+-- Automatic assignment strategy per state.
+-- role_id is the pool of candidates, last_assigned_user_id drives ROUND_ROBIN.
+CREATE TABLE IF NOT EXISTS state_manager.state_assignment_strategy_table (
+    state_name_id         INT PRIMARY KEY REFERENCES state_manager.state_name_table(state_name_id),
+    strategy              VARCHAR(20) NOT NULL CHECK (strategy IN ('ROUND_ROBIN', 'LEAST_OPEN', 'SKILL_BASED')),
+    role_id               INT NOT NULL DEFAULT 2 REFERENCES state_manager.role_table(role_id),
+    last_assigned_user_id INT REFERENCES state_manager.user_table(user_id)
+);
+
+
+-- Assigns a request to an available user according to the strategy of its current state.
+-- Returns the newly assigned user ID, or NULL if the request kept its assignee, the state
+-- has no strategy or nobody is available, so callers only notify actual assignments.
+CREATE OR REPLACE FUNCTION state_manager.auto_assign_request(
+    request_id_input        INT,
+    only_if_unassigned      BOOLEAN DEFAULT FALSE
+)
+RETURNS INT AS $$
+DECLARE
+    temp_state_id    INT;
+    temp_type_id     INT;
+    temp_assignee_id INT;
+    strategy_row     state_manager.state_assignment_strategy_table%ROWTYPE;
+    chosen_user_id   INT;
+BEGIN
+    SELECT current_state, requirement_type_id, assignee_id
+    INTO temp_state_id, temp_type_id, temp_assignee_id
+    FROM state_manager.request_table
+    WHERE request_id = request_id_input;
+
+    IF only_if_unassigned AND temp_assignee_id IS NOT NULL THEN
+        RETURN NULL;
+    END IF;
+
+    SELECT *
+    INTO strategy_row
+    FROM state_manager.state_assignment_strategy_table
+    WHERE state_name_id = temp_state_id;
+
+    IF NOT FOUND THEN
+        RETURN NULL;
+    END IF;
+
+    IF strategy_row.strategy = 'ROUND_ROBIN' THEN
+        -- Take the next available user after the last one, wrapping around to the lowest ID.
+        SELECT u.user_id
+        INTO chosen_user_id
+        FROM state_manager.user_table u
+        JOIN state_manager.user_role_table ur ON u.user_id = ur.user_id
+        WHERE ur.role_id = strategy_row.role_id
+          AND u.available
+        ORDER BY (u.user_id <= COALESCE(strategy_row.last_assigned_user_id, 0)), u.user_id
+        LIMIT 1;
+    ELSE
+        -- LEAST_OPEN and SKILL_BASED both pick the user with the fewest open requests,
+        -- SKILL_BASED prefers users skilled in the request's requirement type.
+        SELECT u.user_id
+        INTO chosen_user_id
+        FROM state_manager.user_table u
+        JOIN state_manager.user_role_table ur ON u.user_id = ur.user_id
+        LEFT JOIN state_manager.analyst_skill_table sk
+            ON sk.user_id = u.user_id AND sk.requirement_type_id = temp_type_id
+        WHERE ur.role_id = strategy_row.role_id
+          AND u.available
+        ORDER BY
+            (strategy_row.strategy = 'SKILL_BASED' AND sk.user_id IS NULL),
+            (
+                SELECT COUNT(*)
+                FROM state_manager.request_table r
+                WHERE r.assignee_id = u.user_id
+                  AND r.current_state = ANY(ARRAY[1, 2, 3, 4])
+            ),
+            u.user_id
+        LIMIT 1;
+    END IF;
+
+    IF chosen_user_id IS NULL THEN
+        RETURN NULL;
+    END IF;
+
+    UPDATE state_manager.request_table
+    SET assignee_id = chosen_user_id
+    WHERE request_id = request_id_input;
+
+    UPDATE state_manager.state_assignment_strategy_table
+    SET last_assigned_user_id = chosen_user_id
+    WHERE state_name_id = temp_state_id;
+
+    RETURN chosen_user_id;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Fetches every worker and validator with their availability, skills and open workload.
+CREATE OR REPLACE FUNCTION state_manager.get_analysts()
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    SELECT json_agg(row_to_json(t))
+    INTO result_json
+    FROM (
+        SELECT
+            u.user_id AS "userId",
+            u.user_name AS "userName",
+            u.available,
+            (
+                SELECT COALESCE(json_agg(sk.requirement_type_id ORDER BY sk.requirement_type_id), '[]'::json)
+                FROM state_manager.analyst_skill_table sk
+                WHERE sk.user_id = u.user_id
+            ) AS "requirementTypeIds",
+            (
+                SELECT COUNT(*)
+                FROM state_manager.request_table r
+                WHERE r.assignee_id = u.user_id
+                  AND r.current_state = ANY(ARRAY[1, 2, 3, 4])
+            ) AS "openCount"
+        FROM state_manager.user_table u
+        WHERE EXISTS (
+            SELECT 1
+            FROM state_manager.user_role_table ur
+            WHERE ur.user_id = u.user_id
+              AND ur.role_id = ANY(ARRAY[2, 3])
+        )
+        ORDER BY u.user_id
+    ) t;
+
+    -- Return an empty JSON array if no results are found.
+    IF result_json IS NULL THEN
+		result_json := '[]'::json;
+	END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Marks an analyst as available or unavailable for automatic assignment.
+CREATE OR REPLACE PROCEDURE state_manager.set_analyst_availability(
+    user_id_input    INT,
+    analyst_id_input INT,
+    available_input  BOOLEAN
+) AS $$
+BEGIN
+    CALL state_manager.assert_user_role(user_id_input, ARRAY[4]);
+
+    UPDATE state_manager.user_table
+    SET available = available_input
+    WHERE user_id = analyst_id_input;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Replaces the set of requirement types an analyst is skilled in.
+CREATE OR REPLACE PROCEDURE state_manager.set_analyst_skills(
+    user_id_input              INT,
+    analyst_id_input           INT,
+    requirement_type_ids_input INT[]
+) AS $$
+BEGIN
+    CALL state_manager.assert_user_role(user_id_input, ARRAY[4]);
+
+    DELETE FROM state_manager.analyst_skill_table
+    WHERE user_id = analyst_id_input;
+
+    INSERT INTO state_manager.analyst_skill_table(user_id, requirement_type_id)
+    SELECT analyst_id_input, type_id
+    FROM unnest(requirement_type_ids_input) AS type_id;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Fetches the configured assignment strategy of every state.
+CREATE OR REPLACE FUNCTION state_manager.get_assignment_strategies()
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    SELECT json_agg(row_to_json(t))
+    INTO result_json
+    FROM (
+        SELECT
+            st.state_name_id AS "stateNameId",
+            n.state_name AS "stateName",
+            st.strategy,
+            st.role_id AS "roleId"
+        FROM state_manager.state_assignment_strategy_table st
+        JOIN state_manager.state_name_table n ON st.state_name_id = n.state_name_id
+        ORDER BY st.state_name_id
+    ) t;
+
+    -- Return an empty JSON array if no results are found.
+    IF result_json IS NULL THEN
+		result_json := '[]'::json;
+	END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Sets the assignment strategy of a state, a NULL strategy turns automatic assignment off.
+CREATE OR REPLACE PROCEDURE state_manager.set_assignment_strategy(
+    user_id_input  INT,
+    state_id_input INT,
+    strategy_input VARCHAR,
+    role_id_input  INT DEFAULT 2
+) AS $$
+BEGIN
+    CALL state_manager.assert_user_role(user_id_input, ARRAY[4]);
+
+    IF strategy_input IS NULL THEN
+        DELETE FROM state_manager.state_assignment_strategy_table
+        WHERE state_name_id = state_id_input;
+        RETURN;
+    END IF;
+
+    INSERT INTO state_manager.state_assignment_strategy_table(state_name_id, strategy, role_id)
+    VALUES (state_id_input, strategy_input, role_id_input)
+    ON CONFLICT (state_name_id) DO UPDATE
+    SET strategy = EXCLUDED.strategy,
+        role_id = EXCLUDED.role_id,
+        last_assigned_user_id = NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Number of distinct approvers a request of this type needs before it is VALIDATED.
+ALTER TABLE state_manager.requirement_type_table
+    ADD COLUMN IF NOT EXISTS required_approvals INT NOT NULL DEFAULT 1 CHECK (required_approvals >= 1);
+
+-- Approvals given to a request while it is SUBMITTED, one per approver.
+CREATE TABLE IF NOT EXISTS state_manager.approval_table (
+    approval_id      SERIAL PRIMARY KEY,
+    request_id       INT NOT NULL REFERENCES state_manager.request_table(request_id),
+    user_id          INT NOT NULL REFERENCES state_manager.user_table(user_id),
+    approved_at      TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    approval_comment TEXT,
+    UNIQUE (request_id, user_id)
+);
+
+
+-- Sets how many distinct approvers a requirement type needs.
+CREATE OR REPLACE PROCEDURE state_manager.set_required_approvals(
+    user_id_input             INT,
+    requirement_type_id_input INT,
+    required_approvals_input  INT
+) AS $$
+BEGIN
+    CALL state_manager.assert_user_role(user_id_input, ARRAY[4]);
+
+    UPDATE state_manager.requirement_type_table
+    SET required_approvals = required_approvals_input
+    WHERE requirement_type_id = requirement_type_id_input;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Update failed: requirement type % does not exist', requirement_type_id_input;
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Threaded comments on requests.
+-- Internal comments are only visible to staff, deleted comments keep their place in the thread.
+CREATE TABLE IF NOT EXISTS state_manager.comment_table (
+    comment_id        SERIAL PRIMARY KEY,
+    request_id        INT NOT NULL REFERENCES state_manager.request_table(request_id),
+    user_id           INT NOT NULL REFERENCES state_manager.user_table(user_id),
+    parent_comment_id INT REFERENCES state_manager.comment_table(comment_id),
+    comment_body      TEXT NOT NULL,
+    internal          BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at        TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    edited_at         TIMESTAMP,
+    deleted_at        TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS comment_table_request_id_idx ON state_manager.comment_table(request_id);
+
+
+-- Returns true if the user is a worker, validator or admin.
+CREATE OR REPLACE FUNCTION state_manager.is_staff(
+    user_id_input INT
+)
+RETURNS BOOLEAN AS $$
+BEGIN
+    RETURN EXISTS (
+        SELECT 1
+        FROM state_manager.user_role_table
+        WHERE user_id = user_id_input
+          AND role_id = ANY(ARRAY[2, 3, 4])
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Returns a single comment with its author and request title as a JSON object.
+CREATE OR REPLACE FUNCTION state_manager.get_comment(
+    comment_id_input INT
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    SELECT row_to_json(t)
+    INTO result_json
+    FROM (
+        SELECT
+            cm.comment_id AS "commentId",
+            cm.request_id AS "requestId",
+            r.request_title AS "requestTitle",
+            cm.user_id AS "userId",
+            u.user_name AS "userName",
+            cm.parent_comment_id AS "parentCommentId",
+            CASE WHEN cm.deleted_at IS NULL THEN cm.comment_body END AS "body",
+            cm.internal,
+            cm.created_at AS "createdAt",
+            cm.edited_at AS "editedAt",
+            cm.deleted_at IS NOT NULL AS "deleted"
+        FROM state_manager.comment_table cm
+        JOIN state_manager.request_table r ON cm.request_id = r.request_id
+        JOIN state_manager.user_table u ON cm.user_id = u.user_id
+        WHERE cm.comment_id = comment_id_input
+    ) t;
+
+    -- Return an empty JSON object if no comment is found.
+    IF result_json IS NULL THEN
+        result_json := '{}'::json;
+    END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Fetches the comment thread of a request, oldest first.
+-- Internal comments are left out unless the viewer is staff.
+CREATE OR REPLACE FUNCTION state_manager.get_request_comments(
+    request_id_input INT,
+    viewer_id_input  INT DEFAULT NULL
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+    show_internal BOOLEAN;
+BEGIN
+    show_internal := viewer_id_input IS NOT NULL AND state_manager.is_staff(viewer_id_input);
+
+    SELECT json_agg(row_to_json(t))
+    INTO result_json
+    FROM (
+        SELECT
+            cm.comment_id AS "commentId",
+            cm.user_id AS "userId",
+            u.user_name AS "userName",
+            cm.parent_comment_id AS "parentCommentId",
+            -- Soft-deleted comments keep their place in the thread without their content.
+            CASE WHEN cm.deleted_at IS NULL THEN cm.comment_body END AS "body",
+            cm.internal,
+            cm.created_at AS "createdAt",
+            cm.edited_at AS "editedAt",
+            cm.deleted_at IS NOT NULL AS "deleted"
+        FROM state_manager.comment_table cm
+        JOIN state_manager.user_table u ON cm.user_id = u.user_id
+        WHERE cm.request_id = request_id_input
+          AND (show_internal OR NOT cm.internal)
+        ORDER BY cm.created_at, cm.comment_id
+    ) t;
+
+    -- Return an empty JSON array if no results are found.
+    IF result_json IS NULL THEN
+		result_json := '[]'::json;
+	END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Posts a comment, or a reply when a parent comment is given.
+-- Only the requester and staff may comment, and only staff may post internal comments.
+CREATE OR REPLACE FUNCTION state_manager.post_comment(
+    request_id_input INT,
+    user_id_input    INT,
+    body_input       TEXT,
+    parent_id_input  INT DEFAULT NULL,
+    internal_input   BOOLEAN DEFAULT FALSE
+)
+RETURNS JSON AS $$
+DECLARE
+    requester_id   INT;
+    user_is_staff  BOOLEAN;
+    new_comment_id INT;
+BEGIN
+    SELECT user_id
+    INTO requester_id
+    FROM state_manager.request_table
+    WHERE request_id = request_id_input;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Comment failed: request % does not exist', request_id_input;
+    END IF;
+
+    user_is_staff := state_manager.is_staff(user_id_input);
+    IF NOT user_is_staff AND requester_id <> user_id_input THEN
+        RAISE EXCEPTION 'Permission denied: user % cannot comment on request %', user_id_input, request_id_input;
+    END IF;
+    IF internal_input AND NOT user_is_staff THEN
+        RAISE EXCEPTION 'Permission denied: user % cannot post internal comments', user_id_input;
+    END IF;
+
+    -- Replies must stay within the same request.
+    IF parent_id_input IS NOT NULL AND NOT EXISTS (
+        SELECT 1
+        FROM state_manager.comment_table
+        WHERE comment_id = parent_id_input
+          AND request_id = request_id_input
+    ) THEN
+        RAISE EXCEPTION 'Comment failed: parent comment % does not belong to request %', parent_id_input, request_id_input;
+    END IF;
+
+    INSERT INTO state_manager.comment_table(request_id, user_id, parent_comment_id, comment_body, internal)
+    VALUES (request_id_input, user_id_input, parent_id_input, body_input, internal_input)
+    RETURNING comment_id INTO new_comment_id;
+
+    RETURN state_manager.get_comment(new_comment_id);
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Edits the author's own comment while it is still inside the edit window.
+CREATE OR REPLACE FUNCTION state_manager.edit_comment(
+    comment_id_input     INT,
+    user_id_input        INT,
+    body_input           TEXT,
+    edit_window_minutes  INT
+)
+RETURNS JSON AS $$
+BEGIN
+    UPDATE state_manager.comment_table
+    SET comment_body = body_input,
+        edited_at = CURRENT_TIMESTAMP
+    WHERE comment_id = comment_id_input
+      AND user_id = user_id_input
+      AND deleted_at IS NULL
+      AND created_at + make_interval(mins => edit_window_minutes) >= CURRENT_TIMESTAMP;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Edit failed: comment % cannot be edited by user %', comment_id_input, user_id_input;
+    END IF;
+
+    RETURN state_manager.get_comment(comment_id_input);
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Soft-deletes a comment, allowed for its author and admins.
+CREATE OR REPLACE PROCEDURE state_manager.delete_comment(
+    comment_id_input INT,
+    user_id_input    INT
+) AS $$
+BEGIN
+    UPDATE state_manager.comment_table cm
+    SET deleted_at = CURRENT_TIMESTAMP
+    WHERE cm.comment_id = comment_id_input
+      AND cm.deleted_at IS NULL
+      AND (
+          cm.user_id = user_id_input
+          OR EXISTS (
+              SELECT 1
+              FROM state_manager.user_role_table ur
+              WHERE ur.user_id = user_id_input
+                AND ur.role_id = 4
+          )
+      );
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Delete failed: comment % cannot be deleted by user %', comment_id_input, user_id_input;
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Resolves @mentioned usernames to the users allowed to read the comment.
+-- Internal comments only reach staff, public ones also reach the requester.
+CREATE OR REPLACE FUNCTION state_manager.get_mention_recipients(
+    request_id_input INT,
+    user_names_input VARCHAR[],
+    internal_input   BOOLEAN
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    SELECT json_agg(row_to_json(t))
+    INTO result_json
+    FROM (
+        SELECT
+            u.user_id AS "userId",
+            u.user_name AS "userName",
+            u.email,
+            u.locale
+        FROM state_manager.user_table u
+        WHERE LOWER(u.user_name) = ANY(SELECT LOWER(n) FROM unnest(user_names_input) AS n)
+          AND (
+              state_manager.is_staff(u.user_id)
+              OR (
+                  NOT internal_input
+                  AND u.user_id = (SELECT r.user_id FROM state_manager.request_table r WHERE r.request_id = request_id_input)
+              )
+          )
+    ) t;
+
+    -- Return an empty JSON array if no results are found.
+    IF result_json IS NULL THEN
+		result_json := '[]'::json;
+	END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Field-level history of edits made to a request after submission.
+-- Answers are recorded with the field name 'answer:<requirement_question_id>'.
+CREATE TABLE IF NOT EXISTS state_manager.request_change_table (
+    change_id   SERIAL PRIMARY KEY,
+    request_id  INT NOT NULL REFERENCES state_manager.request_table(request_id),
+    changed_by  INT NOT NULL REFERENCES state_manager.user_table(user_id),
+    field_name  VARCHAR(100) NOT NULL,
+    old_value   TEXT,
+    new_value   TEXT,
+    changed_at  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS request_change_table_request_id_idx ON state_manager.request_change_table(request_id);
+
+
+-- Fetches the edit history of a request, newest first.
+CREATE OR REPLACE FUNCTION state_manager.get_request_changes(
+    request_id_input INT
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    SELECT json_agg(row_to_json(t))
+    INTO result_json
+    FROM (
+        SELECT
+            ch.field_name AS "fieldName",
+            ch.old_value AS "oldValue",
+            ch.new_value AS "newValue",
+            ch.changed_by AS "changedBy",
+            u.user_name AS "changedByName",
+            ch.changed_at AS "changedAt"
+        FROM state_manager.request_change_table ch
+        JOIN state_manager.user_table u ON ch.changed_by = u.user_id
+        WHERE ch.request_id = request_id_input
+        ORDER BY ch.changed_at DESC, ch.change_id DESC
+    ) t;
+
+    -- Return an empty JSON array if no results are found.
+    IF result_json IS NULL THEN
+		result_json := '[]'::json;
+	END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Records a single field change if the value actually changed.
+-- NULL and an empty string count as the same value.
+CREATE OR REPLACE PROCEDURE state_manager.log_request_change(
+    request_id_input INT,
+    user_id_input    INT,
+    field_name_input VARCHAR,
+    old_value_input  TEXT,
+    new_value_input  TEXT
+) AS $$
+BEGIN
+    IF COALESCE(old_value_input, '') <> COALESCE(new_value_input, '') THEN
+        INSERT INTO state_manager.request_change_table(request_id, changed_by, field_name, old_value, new_value)
+        VALUES (request_id_input, user_id_input, field_name_input, old_value_input, new_value_input);
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Lets the requester edit their request while it is in one of the editable states.
+-- Every changed field is written to request_change_table before the update.
+-- Approvals collected in SUBMITTED were given to the old content, so an edit there clears them.
+-- answers_input is a JSON object of requirement_question_id to answer, questions left out keep their answer.
+DROP PROCEDURE IF EXISTS state_manager.update_request(INT, INT, INT[], VARCHAR, TEXT, TIMESTAMP, VARCHAR, BOOLEAN, TEXT, VARCHAR[]);
+CREATE OR REPLACE PROCEDURE state_manager.update_request(
+    request_id_input               INT,
+    user_id_input                  INT,
+    editable_states                INT[],
+    request_title_input            VARCHAR,
+    analysis_purpose_input         TEXT,
+    requested_completed_date_input TIMESTAMP,
+    pic_submitter_input            VARCHAR,
+    urgent_input                   BOOLEAN,
+    remark_input                   TEXT,
+    answers_input                  JSONB DEFAULT NULL
+) AS $$
+DECLARE
+    old_row    state_manager.request_table%ROWTYPE;
+    answer_row RECORD;
+BEGIN
+    -- Lock the request so concurrent edits and state changes queue up behind this one.
+    SELECT *
+    INTO old_row
+    FROM state_manager.request_table
+    WHERE request_id = request_id_input
+    FOR UPDATE;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Edit failed: request % does not exist', request_id_input;
+    END IF;
+    IF old_row.user_id <> user_id_input THEN
+        RAISE EXCEPTION 'Permission denied: user % is not the requester of request %', user_id_input, request_id_input;
+    END IF;
+    IF NOT old_row.current_state = ANY(editable_states) THEN
+        RAISE EXCEPTION 'Edit failed: request % can no longer be edited in state %', request_id_input, old_row.current_state;
+    END IF;
+
+    CALL state_manager.log_request_change(request_id_input, user_id_input, 'requestTitle', old_row.request_title, request_title_input);
+    CALL state_manager.log_request_change(request_id_input, user_id_input, 'analysisPurpose', old_row.analysis_purpose, analysis_purpose_input);
+    CALL state_manager.log_request_change(request_id_input, user_id_input, 'requestedCompletedDate', old_row.requested_completed_date::TEXT, requested_completed_date_input::TEXT);
+    CALL state_manager.log_request_change(request_id_input, user_id_input, 'picSubmitter', old_row.pic_submitter, pic_submitter_input);
+    CALL state_manager.log_request_change(request_id_input, user_id_input, 'urgent', old_row.urgent::TEXT, urgent_input::TEXT);
+    CALL state_manager.log_request_change(request_id_input, user_id_input, 'remark', old_row.remark, remark_input);
+
+    UPDATE state_manager.request_table
+    SET request_title = request_title_input,
+        analysis_purpose = analysis_purpose_input,
+        requested_completed_date = requested_completed_date_input,
+        pic_submitter = pic_submitter_input,
+        urgent = urgent_input,
+        remark = remark_input
+    WHERE request_id = request_id_input;
+
+    IF old_row.current_state = 1 THEN
+        DELETE FROM state_manager.approval_table
+        WHERE request_id = request_id_input;
+    END IF;
+
+    IF answers_input IS NOT NULL THEN
+        FOR answer_row IN
+            SELECT re.requirement_id, re.requirement_question_id, re.answer
+            FROM state_manager.requirement_table re
+            JOIN state_manager.requirement_question_table q ON re.requirement_question_id = q.requirement_question_id
+            WHERE re.request_id = request_id_input
+              AND answers_input ? re.requirement_question_id::TEXT
+            ORDER BY q.position, re.requirement_question_id
+        LOOP
+            CALL state_manager.log_request_change(
+                request_id_input, user_id_input,
+                'answer:' || answer_row.requirement_question_id,
+                answer_row.answer, answers_input ->> answer_row.requirement_question_id::TEXT
+            );
+        END LOOP;
+
+        -- One statement for every answer, so the search document is rebuilt once.
+        UPDATE state_manager.requirement_table
+        SET answer = NULLIF(answers_input ->> requirement_question_id::TEXT, '')
+        WHERE request_id = request_id_input
+          AND answers_input ? requirement_question_id::TEXT;
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Drafts are requests that have not entered the workflow yet.
+-- Every field is optional until the draft is submitted through create_new_request.
+CREATE TABLE IF NOT EXISTS state_manager.draft_table (
+    draft_id                 SERIAL PRIMARY KEY,
+    user_id                  INT NOT NULL REFERENCES state_manager.user_table(user_id),
+    request_title            VARCHAR,
+    requester_name           VARCHAR,
+    analysis_purpose         TEXT,
+    requested_completed_date TIMESTAMP,
+    pic_submitter            VARCHAR,
+    urgent                   BOOLEAN,
+    requirement_type_id      INT REFERENCES state_manager.requirement_type_table(requirement_type_id),
+    answers                  JSONB,
+    remark                   TEXT,
+    docx_filename            VARCHAR,
+    docx_path                VARCHAR,
+    excel_filename           VARCHAR,
+    excel_path               VARCHAR,
+    created_at               TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at               TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS draft_table_user_id_idx ON state_manager.draft_table(user_id);
+
+-- Answers are a JSON object of requirement_question_id to answer. Drafts saved before that
+-- hold a JSON array of answers in question order, which is still accepted on submission.
+ALTER TABLE state_manager.draft_table
+    ALTER COLUMN answers TYPE JSONB USING to_jsonb(answers);
+
+
+-- Returns a single draft of a user as a JSON object, or an empty object if it does not exist.
+CREATE OR REPLACE FUNCTION state_manager.get_draft(
+    draft_id_input INT,
+    user_id_input  INT
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    SELECT row_to_json(t)
+    INTO result_json
+    FROM (
+        SELECT
+            d.draft_id AS "draftId",
+            d.user_id AS "userId",
+            'DRAFT' AS "stateName",
+            d.request_title AS "requestTitle",
+            d.requester_name AS "requesterName",
+            d.analysis_purpose AS "analysisPurpose",
+            d.requested_completed_date AS "requestedCompletedDate",
+            d.pic_submitter AS "picSubmitter",
+            d.urgent,
+            d.requirement_type_id AS "requirementTypeId",
+            d.answers,
+            d.remark,
+            d.docx_filename AS "docxFilename",
+            d.docx_path AS "docxPath",
+            d.excel_filename AS "excelFilename",
+            d.excel_path AS "excelPath",
+            d.source_request_id AS "sourceRequestId",
+            d.created_at AS "createdAt",
+            d.updated_at AS "updatedAt"
+        FROM state_manager.draft_table d
+        WHERE d.draft_id = draft_id_input
+          AND d.user_id = user_id_input
+    ) t;
+
+    -- Return an empty JSON object if no draft is found.
+    IF result_json IS NULL THEN
+        result_json := '{}'::json;
+    END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Fetches a summary of a user's drafts, most recently edited first.
+CREATE OR REPLACE FUNCTION state_manager.get_user_drafts(
+    user_id_input INT
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    SELECT json_agg(row_to_json(t))
+    INTO result_json
+    FROM (
+        SELECT
+            d.draft_id AS "draftId",
+            d.request_title AS "requestTitle",
+            d.requirement_type_id AS "requirementTypeId",
+            rt.data_type_name AS "dataTypeName",
+            'DRAFT' AS "stateName",
+            d.created_at AS "createdAt",
+            d.updated_at AS "updatedAt"
+        FROM state_manager.draft_table d
+        LEFT JOIN state_manager.requirement_type_table rt ON d.requirement_type_id = rt.requirement_type_id
+        WHERE d.user_id = user_id_input
+        ORDER BY d.updated_at DESC
+    ) t;
+
+    -- Return an empty JSON array if no results are found.
+    IF result_json IS NULL THEN
+		result_json := '[]'::json;
+	END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Creates a draft, or updates one when a draft ID is given.
+-- NULL inputs keep the stored value so the client can autosave only what changed.
+DROP FUNCTION IF EXISTS state_manager.save_draft(INT, INT, VARCHAR, VARCHAR, TEXT, TIMESTAMP, VARCHAR, BOOLEAN, INT, VARCHAR[], TEXT, VARCHAR, VARCHAR, VARCHAR, VARCHAR);
+DROP FUNCTION IF EXISTS state_manager.save_draft(INT, INT, VARCHAR, VARCHAR, TEXT, TIMESTAMP, VARCHAR, BOOLEAN, INT, VARCHAR[], TEXT, VARCHAR, VARCHAR, VARCHAR, VARCHAR, INT);
+CREATE OR REPLACE FUNCTION state_manager.save_draft(
+    draft_id_input                 INT,
+    user_id_input                  INT,
+    request_title_input            VARCHAR,
+    requester_name_input           VARCHAR,
+    analysis_purpose_input         TEXT,
+    requested_completed_date_input TIMESTAMP,
+    pic_submitter_input            VARCHAR,
+    urgent_input                   BOOLEAN,
+    requirement_type_input         INT,
+    answers_input                  JSONB,
+    remark_input                   TEXT,
+    docx_filename_input            VARCHAR,
+    docx_path_input                VARCHAR,
+    excel_filename_input           VARCHAR,
+    excel_path_input               VARCHAR,
+    source_request_id_input        INT DEFAULT NULL
+)
+RETURNS JSON AS $$
+DECLARE
+    temp_draft_id INT;
+BEGIN
+    IF draft_id_input IS NULL THEN
+        INSERT INTO state_manager.draft_table (
+            user_id, request_title, requester_name, analysis_purpose,
+            requested_completed_date, pic_submitter, urgent,
+            requirement_type_id, answers, remark,
+            docx_filename, docx_path, excel_filename, excel_path, source_request_id
+        )
+        VALUES (
+            user_id_input, request_title_input, requester_name_input, analysis_purpose_input,
+            requested_completed_date_input, pic_submitter_input, urgent_input,
+            requirement_type_input, answers_input, remark_input,
+            docx_filename_input, docx_path_input, excel_filename_input, excel_path_input, source_request_id_input
+        )
+        RETURNING draft_id INTO temp_draft_id;
+    ELSE
+        UPDATE state_manager.draft_table
+        SET request_title = COALESCE(request_title_input, request_title),
+            requester_name = COALESCE(requester_name_input, requester_name),
+            analysis_purpose = COALESCE(analysis_purpose_input, analysis_purpose),
+            requested_completed_date = COALESCE(requested_completed_date_input, requested_completed_date),
+            pic_submitter = COALESCE(pic_submitter_input, pic_submitter),
+            urgent = COALESCE(urgent_input, urgent),
+            requirement_type_id = COALESCE(requirement_type_input, requirement_type_id),
+            answers = COALESCE(answers_input, answers),
+            remark = COALESCE(remark_input, remark),
+            docx_filename = COALESCE(docx_filename_input, docx_filename),
+            docx_path = COALESCE(docx_path_input, docx_path),
+            excel_filename = COALESCE(excel_filename_input, excel_filename),
+            excel_path = COALESCE(excel_path_input, excel_path),
+            updated_at = CURRENT_TIMESTAMP
+        WHERE draft_id = draft_id_input
+          AND user_id = user_id_input
+        RETURNING draft_id INTO temp_draft_id;
+
+        IF temp_draft_id IS NULL THEN
+            RAISE EXCEPTION 'Save failed: draft % does not belong to user %', draft_id_input, user_id_input;
+        END IF;
+    END IF;
+
+    RETURN state_manager.get_draft(temp_draft_id, user_id_input);
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Deletes a user's draft, used both on discard and after it has been submitted.
+-- Returns the blob URLs of its uploads, for the caller to delete those nothing else uses.
+DROP PROCEDURE IF EXISTS state_manager.delete_draft(INT, INT);
+CREATE OR REPLACE FUNCTION state_manager.delete_draft(
+    draft_id_input INT,
+    user_id_input  INT
+)
+RETURNS JSON AS $$
+DECLARE
+    deleted_row state_manager.draft_table%ROWTYPE;
+BEGIN
+    DELETE FROM state_manager.draft_table
+    WHERE draft_id = draft_id_input
+      AND user_id = user_id_input
+    RETURNING * INTO deleted_row;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Delete failed: draft % does not belong to user %', draft_id_input, user_id_input;
+    END IF;
+
+    RETURN COALESCE((
+        SELECT json_agg(path)
+        FROM unnest(ARRAY[deleted_row.docx_path, deleted_row.excel_path]) AS path
+        WHERE COALESCE(path, '') <> ''
+    ), '[]'::json);
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Removes drafts that have not been touched for the given number of days.
+-- Returns {"purged": count, "paths": [...]} with the blob URLs of the purged drafts' uploads.
+DROP FUNCTION IF EXISTS state_manager.purge_drafts(INT);
+CREATE OR REPLACE FUNCTION state_manager.purge_drafts(
+    max_age_days INT
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    WITH purged AS (
+        DELETE FROM state_manager.draft_table
+        WHERE updated_at < CURRENT_TIMESTAMP - make_interval(days => max_age_days)
+        RETURNING docx_path, excel_path
+    )
+    SELECT json_build_object(
+        'purged', (SELECT COUNT(*) FROM purged),
+        'paths', COALESCE((
+            SELECT json_agg(path)
+            FROM purged, unnest(ARRAY[docx_path, excel_path]) AS path
+            WHERE COALESCE(path, '') <> ''
+        ), '[]'::json)
+    )
+    INTO result_json;
+
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Back-reference from a cloned request or draft to the request it was copied from.
+ALTER TABLE state_manager.request_table
+    ADD COLUMN IF NOT EXISTS source_request_id INT REFERENCES state_manager.request_table(request_id);
+ALTER TABLE state_manager.draft_table
+    ADD COLUMN IF NOT EXISTS source_request_id INT REFERENCES state_manager.request_table(request_id);
+
+
+-- Fetches the stored attachments of a request including their file paths, used when copying a request.
+CREATE OR REPLACE FUNCTION state_manager.get_attachment_paths(
+    request_id_input INT
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    SELECT json_agg(row_to_json(t))
+    INTO result_json
+    FROM (
+        SELECT
+            attachment_type_id AS "attachmentTypeId",
+            attachment_filename AS "attachmentFilename",
+            attachment_path AS "attachmentPath"
+        FROM state_manager.attachment_table
+        WHERE request_id = request_id_input
+          AND attachment_path <> ''
+        ORDER BY attachment_type_id
+    ) t;
+
+    -- Return an empty JSON array if no results are found.
+    IF result_json IS NULL THEN
+		result_json := '[]'::json;
+	END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Returns which of the given blob URLs no request, draft or recurrence points to anymore.
+-- Copies reuse the blob URLs of their source, so a replaced upload may still be in use.
+CREATE OR REPLACE FUNCTION state_manager.get_unreferenced_blobs(
+    paths_input VARCHAR[]
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    SELECT json_agg(DISTINCT p.path)
+    INTO result_json
+    FROM unnest(paths_input) AS p(path)
+    WHERE NOT EXISTS (SELECT 1 FROM state_manager.attachment_table a WHERE a.attachment_path = p.path)
+      AND NOT EXISTS (SELECT 1 FROM state_manager.draft_table d WHERE p.path IN (d.docx_path, d.excel_path))
+      AND NOT EXISTS (SELECT 1 FROM state_manager.recurrence_table rc WHERE p.path IN (rc.docx_path, rc.excel_path));
+
+    IF result_json IS NULL THEN
+        result_json := '[]'::json;
+    END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Recurring requests, created automatically from a stored snapshot of a request.
+-- recurrence_rule is one of DAILY, WEEKLY:<1-7>, MONTHLY:<1-31> or FIRST_WORKING_DAY_MONTHLY.
+CREATE TABLE IF NOT EXISTS state_manager.recurrence_table (
+    recurrence_id       SERIAL PRIMARY KEY,
+    user_id             INT NOT NULL REFERENCES state_manager.user_table(user_id),
+    source_request_id   INT REFERENCES state_manager.request_table(request_id),
+    recurrence_rule     VARCHAR(50) NOT NULL,
+    lead_days           INT NOT NULL DEFAULT 7,
+    request_title       VARCHAR NOT NULL,
+    requester_name      VARCHAR,
+    analysis_purpose    TEXT NOT NULL,
+    pic_submitter       VARCHAR,
+    urgent              BOOLEAN NOT NULL DEFAULT FALSE,
+    requirement_type_id INT NOT NULL REFERENCES state_manager.requirement_type_table(requirement_type_id),
+    answers             JSONB,
+    remark              TEXT,
+    docx_filename       VARCHAR,
+    docx_path           VARCHAR,
+    excel_filename      VARCHAR,
+    excel_path          VARCHAR,
+    paused              BOOLEAN NOT NULL DEFAULT FALSE,
+    next_run_at         TIMESTAMP NOT NULL,
+    created_at          TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- One row per attempt to create a request from a recurrence.
+CREATE TABLE IF NOT EXISTS state_manager.recurrence_run_table (
+    run_id         SERIAL PRIMARY KEY,
+    recurrence_id  INT NOT NULL REFERENCES state_manager.recurrence_table(recurrence_id) ON DELETE CASCADE,
+    run_at         TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    request_id     INT REFERENCES state_manager.request_table(request_id),
+    success        BOOLEAN NOT NULL,
+    error_message  TEXT
+);
+
+
+-- Answers are a JSON object of requirement_question_id to answer, see draft_table.
+ALTER TABLE state_manager.recurrence_table
+    ALTER COLUMN answers TYPE JSONB USING to_jsonb(answers);
+
+
+-- Stores a new recurrence and returns it as a JSON object.
+DROP FUNCTION IF EXISTS state_manager.create_recurrence(INT, INT, VARCHAR, INT, VARCHAR, VARCHAR, TEXT, VARCHAR, BOOLEAN, INT, VARCHAR[], TEXT, VARCHAR, VARCHAR, VARCHAR, VARCHAR, TIMESTAMP);
+CREATE OR REPLACE FUNCTION state_manager.create_recurrence(
+    user_id_input             INT,
+    source_request_id_input   INT,
+    recurrence_rule_input     VARCHAR,
+    lead_days_input           INT,
+    request_title_input       VARCHAR,
+    requester_name_input      VARCHAR,
+    analysis_purpose_input    TEXT,
+    pic_submitter_input       VARCHAR,
+    urgent_input              BOOLEAN,
+    requirement_type_input    INT,
+    answers_input             JSONB,
+    remark_input              TEXT,
+    docx_filename_input       VARCHAR,
+    docx_path_input           VARCHAR,
+    excel_filename_input      VARCHAR,
+    excel_path_input          VARCHAR,
+    next_run_at_input         TIMESTAMP
+)
+RETURNS JSON AS $$
+DECLARE
+    temp_recurrence_id INT;
+BEGIN
+    INSERT INTO state_manager.recurrence_table (
+        user_id, source_request_id, recurrence_rule, lead_days,
+        request_title, requester_name, analysis_purpose, pic_submitter, urgent,
+        requirement_type_id, answers, remark,
+        docx_filename, docx_path, excel_filename, excel_path, next_run_at
+    )
+    VALUES (
+        user_id_input, source_request_id_input, recurrence_rule_input, lead_days_input,
+        request_title_input, requester_name_input, analysis_purpose_input, pic_submitter_input, urgent_input,
+        requirement_type_input, answers_input, remark_input,
+        docx_filename_input, docx_path_input, excel_filename_input, excel_path_input, next_run_at_input
+    )
+    RETURNING recurrence_id INTO temp_recurrence_id;
+
+    RETURN (
+        SELECT row_to_json(t)
+        FROM (
+            SELECT
+                recurrence_id AS "recurrenceId",
+                recurrence_rule AS "recurrenceRule",
+                request_title AS "requestTitle",
+                next_run_at AS "nextRunAt"
+            FROM state_manager.recurrence_table
+            WHERE recurrence_id = temp_recurrence_id
+        ) t
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Fetches the recurrences of a user with the outcome of their latest run.
+CREATE OR REPLACE FUNCTION state_manager.get_user_recurrences(
+    user_id_input INT
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    SELECT json_agg(row_to_json(t))
+    INTO result_json
+    FROM (
+        SELECT
+            rc.recurrence_id AS "recurrenceId",
+            rc.source_request_id AS "sourceRequestId",
+            rc.recurrence_rule AS "recurrenceRule",
+            rc.lead_days AS "leadDays",
+            rc.request_title AS "requestTitle",
+            rt.data_type_name AS "dataTypeName",
+            rc.paused,
+            rc.next_run_at AS "nextRunAt",
+            lr.run_at AS "lastRunAt",
+            lr.success AS "lastRunSuccess"
+        FROM state_manager.recurrence_table rc
+        JOIN state_manager.requirement_type_table rt ON rc.requirement_type_id = rt.requirement_type_id
+        LEFT JOIN LATERAL (
+            SELECT run.run_at, run.success
+            FROM state_manager.recurrence_run_table run
+            WHERE run.recurrence_id = rc.recurrence_id
+            ORDER BY run.run_at DESC
+            LIMIT 1
+        ) lr ON TRUE
+        WHERE rc.user_id = user_id_input
+        ORDER BY rc.next_run_at
+    ) t;
+
+    -- Return an empty JSON array if no results are found.
+    IF result_json IS NULL THEN
+		result_json := '[]'::json;
+	END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Pauses or resumes a user's recurrence.
+CREATE OR REPLACE PROCEDURE state_manager.set_recurrence_paused(
+    recurrence_id_input INT,
+    user_id_input       INT,
+    paused_input        BOOLEAN
+) AS $$
+BEGIN
+    UPDATE state_manager.recurrence_table
+    SET paused = paused_input
+    WHERE recurrence_id = recurrence_id_input
+      AND user_id = user_id_input;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Update failed: recurrence % does not belong to user %', recurrence_id_input, user_id_input;
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Deletes a user's recurrence together with its run history.
+CREATE OR REPLACE PROCEDURE state_manager.delete_recurrence(
+    recurrence_id_input INT,
+    user_id_input       INT
+) AS $$
+BEGIN
+    DELETE FROM state_manager.recurrence_table
+    WHERE recurrence_id = recurrence_id_input
+      AND user_id = user_id_input;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Delete failed: recurrence % does not belong to user %', recurrence_id_input, user_id_input;
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Fetches the run history of a user's recurrence, newest first.
+CREATE OR REPLACE FUNCTION state_manager.get_recurrence_runs(
+    recurrence_id_input INT,
+    user_id_input       INT
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    SELECT json_agg(row_to_json(t))
+    INTO result_json
+    FROM (
+        SELECT
+            run.run_id AS "runId",
+            run.run_at AS "runAt",
+            run.request_id AS "requestId",
+            run.success,
+            run.error_message AS "errorMessage"
+        FROM state_manager.recurrence_run_table run
+        JOIN state_manager.recurrence_table rc ON run.recurrence_id = rc.recurrence_id
+        WHERE run.recurrence_id = recurrence_id_input
+          AND rc.user_id = user_id_input
+        ORDER BY run.run_at DESC
+    ) t;
+
+    -- Return an empty JSON array if no results are found.
+    IF result_json IS NULL THEN
+		result_json := '[]'::json;
+	END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Claims up to limit_input active recurrences that are due, including the stored request snapshot.
+-- Claimed recurrences are pushed lease_seconds_input into the future, so concurrent runs skip them
+-- and a run that dies before recording its outcome is retried once the lease expires.
+DROP FUNCTION IF EXISTS state_manager.get_due_recurrences();
+CREATE OR REPLACE FUNCTION state_manager.claim_due_recurrences(
+    limit_input         INT,
+    lease_seconds_input INT
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    WITH claimed AS (
+        UPDATE state_manager.recurrence_table rc
+        SET next_run_at = CURRENT_TIMESTAMP + make_interval(secs => lease_seconds_input)
+        WHERE rc.recurrence_id IN (
+            SELECT recurrence_id
+            FROM state_manager.recurrence_table
+            WHERE NOT paused
+              AND next_run_at <= CURRENT_TIMESTAMP
+            ORDER BY next_run_at, recurrence_id
+            LIMIT limit_input
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING rc.*
+    )
+    SELECT json_agg(row_to_json(t))
+    INTO result_json
+    FROM (
+        SELECT
+            recurrence_id AS "recurrenceId",
+            user_id AS "userId",
+            source_request_id AS "sourceRequestId",
+            recurrence_rule AS "recurrenceRule",
+            lead_days AS "leadDays",
+            request_title AS "requestTitle",
+            requester_name AS "requesterName",
+            analysis_purpose AS "analysisPurpose",
+            pic_submitter AS "picSubmitter",
+            urgent,
+            requirement_type_id AS "requirementTypeId",
+            answers,
+            remark,
+            docx_filename AS "docxFilename",
+            docx_path AS "docxPath",
+            excel_filename AS "excelFilename",
+            excel_path AS "excelPath",
+            next_run_at AS "nextRunAt"
+        FROM claimed
+        ORDER BY recurrence_id
+    ) t;
+
+    -- Return an empty JSON array if no results are found.
+    IF result_json IS NULL THEN
+		result_json := '[]'::json;
+	END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Records the outcome of a recurrence run and schedules the next one.
+-- A successful run is recorded in the transaction that created its request.
+CREATE OR REPLACE PROCEDURE state_manager.record_recurrence_run(
+    recurrence_id_input INT,
+    request_id_input    INT,
+    success_input       BOOLEAN,
+    error_message_input TEXT,
+    next_run_at_input   TIMESTAMP
+) AS $$
+BEGIN
+    INSERT INTO state_manager.recurrence_run_table(recurrence_id, request_id, success, error_message)
+    VALUES (recurrence_id_input, request_id_input, success_input, error_message_input);
+
+    UPDATE state_manager.recurrence_table
+    SET next_run_at = next_run_at_input
+    WHERE recurrence_id = recurrence_id_input;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Typed questionnaire questions.
+-- min_value and max_value bound the length of TEXT answers, the value of NUMBER answers
+-- and the number of selected options of MULTI_SELECT answers.
+ALTER TABLE state_manager.requirement_question_table
+    ADD COLUMN IF NOT EXISTS question_type VARCHAR(20) NOT NULL DEFAULT 'TEXT'
+        CHECK (question_type IN ('TEXT', 'NUMBER', 'DATE', 'SINGLE_SELECT', 'MULTI_SELECT', 'YES_NO', 'FILE')),
+    ADD COLUMN IF NOT EXISTS required BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN IF NOT EXISTS min_value NUMERIC,
+    ADD COLUMN IF NOT EXISTS max_value NUMERIC,
+    ADD COLUMN IF NOT EXISTS pattern VARCHAR,
+    ADD COLUMN IF NOT EXISTS options JSONB;
+
+-- The existing yes/no question of the Dataset (Penambahan Column) form.
+UPDATE state_manager.requirement_question_table
+SET question_type = 'YES_NO'
+WHERE requirement_question_id = 204;
+
+
+-- Conditional questionnaire logic.
+-- Both columns hold a JSON array of conditions that must all hold, each condition being
+-- {"questionId": <requirement_question_id>, "operator": "EQUALS" | "NOT_EQUALS" | "IN" | "NOT_EMPTY", "value": ..., "values": [...]}.
+-- A question whose visible_when does not hold is hidden: it is never required and its answer is stored as NULL.
+ALTER TABLE state_manager.requirement_question_table
+    ADD COLUMN IF NOT EXISTS visible_when JSONB,
+    ADD COLUMN IF NOT EXISTS required_when JSONB;
+
+
+-- Versioned questionnaires.
+-- Questions belong to a questionnaire version instead of encoding their requirement type in
+-- their ID. Versions are never edited once a request has been answered against them: an edit
+-- copies the current version first, so older requests keep the questions they were asked.
+CREATE TABLE IF NOT EXISTS state_manager.questionnaire_version_table (
+    questionnaire_version_id SERIAL PRIMARY KEY,
+    requirement_type_id      INT NOT NULL REFERENCES state_manager.requirement_type_table(requirement_type_id),
+    version_number           INT NOT NULL,
+    created_by               INT REFERENCES state_manager.user_table(user_id),
+    created_at               TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (requirement_type_id, version_number)
+);
+
+ALTER TABLE state_manager.requirement_type_table
+    ADD COLUMN IF NOT EXISTS current_version_id INT REFERENCES state_manager.questionnaire_version_table(questionnaire_version_id),
+    ADD COLUMN IF NOT EXISTS active BOOLEAN NOT NULL DEFAULT TRUE;
+
+-- copied_from_question_id links a question to the question it was copied from in the previous version.
+ALTER TABLE state_manager.requirement_question_table
+    ADD COLUMN IF NOT EXISTS questionnaire_version_id INT REFERENCES state_manager.questionnaire_version_table(questionnaire_version_id),
+    ADD COLUMN IF NOT EXISTS position INT,
+    ADD COLUMN IF NOT EXISTS copied_from_question_id INT;
+
+-- The questionnaire version a request was answered against.
+ALTER TABLE state_manager.request_table
+    ADD COLUMN IF NOT EXISTS questionnaire_version_id INT REFERENCES state_manager.questionnaire_version_table(questionnaire_version_id);
+
+CREATE SEQUENCE IF NOT EXISTS state_manager.requirement_type_id_seq OWNED BY state_manager.requirement_type_table.requirement_type_id;
+CREATE SEQUENCE IF NOT EXISTS state_manager.requirement_question_id_seq OWNED BY state_manager.requirement_question_table.requirement_question_id;
+ALTER TABLE state_manager.requirement_type_table
+    ALTER COLUMN requirement_type_id SET DEFAULT nextval('state_manager.requirement_type_id_seq');
+ALTER TABLE state_manager.requirement_question_table
+    ALTER COLUMN requirement_question_id SET DEFAULT nextval('state_manager.requirement_question_id_seq');
+
+
+-- Moves questions that were inserted with encoded IDs (requirement_type_id * 100 + n) into a
+-- first questionnaire version of their type and moves the ID sequences past the inserted IDs.
+-- Safe to run again, it only touches rows that have no version yet.
+CREATE OR REPLACE PROCEDURE state_manager.migrate_questionnaire_versions()
+AS $$
+BEGIN
+    INSERT INTO state_manager.questionnaire_version_table(requirement_type_id, version_number)
+    SELECT t.requirement_type_id, 1
+    FROM state_manager.requirement_type_table t
+    WHERE t.current_version_id IS NULL
+      AND NOT EXISTS (
+          SELECT 1 FROM state_manager.questionnaire_version_table v
+          WHERE v.requirement_type_id = t.requirement_type_id
+      );
+
+    UPDATE state_manager.requirement_type_table t
+    SET current_version_id = v.questionnaire_version_id
+    FROM state_manager.questionnaire_version_table v
+    WHERE v.requirement_type_id = t.requirement_type_id
+      AND v.version_number = 1
+      AND t.current_version_id IS NULL;
+
+    UPDATE state_manager.requirement_question_table q
+    SET questionnaire_version_id = t.current_version_id,
+        position = q.requirement_question_id - q.requirement_type_id * 100
+    FROM state_manager.requirement_type_table t
+    WHERE q.requirement_type_id = t.requirement_type_id
+      AND q.questionnaire_version_id IS NULL;
+
+    UPDATE state_manager.request_table r
+    SET questionnaire_version_id = t.current_version_id
+    FROM state_manager.requirement_type_table t
+    WHERE r.requirement_type_id = t.requirement_type_id
+      AND r.questionnaire_version_id IS NULL;
+
+    PERFORM setval('state_manager.requirement_type_id_seq',
+        GREATEST((SELECT MAX(requirement_type_id) FROM state_manager.requirement_type_table), 1));
+    PERFORM setval('state_manager.requirement_question_id_seq',
+        GREATEST((SELECT MAX(requirement_question_id) FROM state_manager.requirement_question_table), 1));
+END;
+$$ LANGUAGE plpgsql;
+
+CALL state_manager.migrate_questionnaire_versions();
+
+
+-- Lists every requirement type, including inactive ones, with its current questionnaire version.
+CREATE OR REPLACE FUNCTION state_manager.get_requirement_types_admin(
+    user_id_input INT
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    CALL state_manager.assert_user_role(user_id_input, ARRAY[4]);
+
+    SELECT json_agg(row_to_json(t))
+    INTO result_json
+    FROM (
+        SELECT
+            rt.requirement_type_id AS "requirementTypeId",
+            rt.data_type_name AS "dataTypeName",
+            rt.active,
+            rt.required_approvals AS "requiredApprovals",
+            rt.current_version_id AS "currentVersionId",
+            v.version_number AS "versionNumber",
+            (SELECT COUNT(*) FROM state_manager.requirement_question_table q
+             WHERE q.questionnaire_version_id = rt.current_version_id) AS "questionCount"
+        FROM state_manager.requirement_type_table rt
+        LEFT JOIN state_manager.questionnaire_version_table v ON rt.current_version_id = v.questionnaire_version_id
+        ORDER BY rt.requirement_type_id
+    ) t;
+
+    IF result_json IS NULL THEN
+        result_json := '[]'::json;
+    END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Creates a requirement type with an empty first questionnaire version and returns its ID.
+CREATE OR REPLACE FUNCTION state_manager.create_requirement_type(
+    user_id_input            INT,
+    data_type_name_input     VARCHAR,
+    required_approvals_input INT
+)
+RETURNS INT AS $$
+DECLARE
+    new_type_id    INT;
+    new_version_id INT;
+BEGIN
+    CALL state_manager.assert_user_role(user_id_input, ARRAY[4]);
+
+    INSERT INTO state_manager.requirement_type_table(data_type_name, required_approvals)
+    VALUES (data_type_name_input, required_approvals_input)
+    RETURNING requirement_type_id INTO new_type_id;
+
+    INSERT INTO state_manager.questionnaire_version_table(requirement_type_id, version_number, created_by)
+    VALUES (new_type_id, 1, user_id_input)
+    RETURNING questionnaire_version_id INTO new_version_id;
+
+    UPDATE state_manager.requirement_type_table
+    SET current_version_id = new_version_id
+    WHERE requirement_type_id = new_type_id;
+
+    RETURN new_type_id;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Renames a requirement type or (de)activates it. Inactive types are not offered for new
+-- requests but keep their existing requests.
+CREATE OR REPLACE PROCEDURE state_manager.update_requirement_type(
+    user_id_input             INT,
+    requirement_type_id_input INT,
+    data_type_name_input      VARCHAR,
+    active_input              BOOLEAN
+) AS $$
+BEGIN
+    CALL state_manager.assert_user_role(user_id_input, ARRAY[4]);
+
+    UPDATE state_manager.requirement_type_table
+    SET data_type_name = COALESCE(data_type_name_input, data_type_name),
+        active = COALESCE(active_input, active)
+    WHERE requirement_type_id = requirement_type_id_input;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Update failed: requirement type % does not exist', requirement_type_id_input;
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Lists the questionnaire versions of a requirement type, newest first.
+CREATE OR REPLACE FUNCTION state_manager.get_questionnaire_versions(
+    user_id_input             INT,
+    requirement_type_id_input INT
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    CALL state_manager.assert_user_role(user_id_input, ARRAY[4]);
+
+    SELECT json_agg(row_to_json(t))
+    INTO result_json
+    FROM (
+        SELECT
+            v.questionnaire_version_id AS "questionnaireVersionId",
+            v.version_number AS "versionNumber",
+            v.created_at AS "createdAt",
+            u.user_name AS "createdBy",
+            v.questionnaire_version_id = rt.current_version_id AS "current",
+            (SELECT COUNT(*) FROM state_manager.request_table r
+             WHERE r.questionnaire_version_id = v.questionnaire_version_id) AS "requestCount",
+            (SELECT json_agg(json_build_object(
+                        'requirementQuestionId', q.requirement_question_id,
+                        'requirementQuestion', q.requirement_question,
+                        'questionType', q.question_type,
+                        'position', q.position
+                    ) ORDER BY q.position)
+             FROM state_manager.requirement_question_table q
+             WHERE q.questionnaire_version_id = v.questionnaire_version_id) AS "questions"
+        FROM state_manager.questionnaire_version_table v
+        JOIN state_manager.requirement_type_table rt ON v.requirement_type_id = rt.requirement_type_id
+        LEFT JOIN state_manager.user_table u ON v.created_by = u.user_id
+        WHERE v.requirement_type_id = requirement_type_id_input
+        ORDER BY v.version_number DESC
+    ) t;
+
+    IF result_json IS NULL THEN
+        result_json := '[]'::json;
+    END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Returns the questionnaire version of a requirement type that may be edited.
+-- The current version is edited in place while no request has been answered against it,
+-- otherwise it is copied into a new current version first.
+CREATE OR REPLACE FUNCTION state_manager.open_questionnaire_version(
+    user_id_input             INT,
+    requirement_type_id_input INT
+)
+RETURNS INT AS $$
+DECLARE
+    old_version_id INT;
+    new_version_id INT;
+BEGIN
+    SELECT current_version_id
+    INTO old_version_id
+    FROM state_manager.requirement_type_table
+    WHERE requirement_type_id = requirement_type_id_input
+    FOR UPDATE;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Requirement type % does not exist', requirement_type_id_input;
+    END IF;
+
+    IF old_version_id IS NOT NULL AND NOT EXISTS (
+        SELECT 1 FROM state_manager.request_table WHERE questionnaire_version_id = old_version_id
+    ) THEN
+        RETURN old_version_id;
+    END IF;
+
+    INSERT INTO state_manager.questionnaire_version_table(requirement_type_id, version_number, created_by)
+    SELECT requirement_type_id_input, COALESCE(MAX(version_number), 0) + 1, user_id_input
+    FROM state_manager.questionnaire_version_table
+    WHERE requirement_type_id = requirement_type_id_input
+    RETURNING questionnaire_version_id INTO new_version_id;
+
+    INSERT INTO state_manager.requirement_question_table(
+        requirement_question, requirement_type_id, question_type, required, min_value, max_value,
+        pattern, options, visible_when, required_when, questionnaire_version_id, position, copied_from_question_id
+    )
+    SELECT
+        requirement_question, requirement_type_id, question_type, required, min_value, max_value,
+        pattern, options, visible_when, required_when, new_version_id, position, requirement_question_id
+    FROM state_manager.requirement_question_table
+    WHERE questionnaire_version_id = old_version_id;
+
+    UPDATE state_manager.requirement_type_table
+    SET current_version_id = new_version_id
+    WHERE requirement_type_id = requirement_type_id_input;
+
+    RETURN new_version_id;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Points the question IDs of a list of conditions at the copies made in a questionnaire version.
+-- IDs that were not copied into the version are left as they are.
+CREATE OR REPLACE FUNCTION state_manager.remap_conditions(
+    conditions       JSONB,
+    version_id_input INT
+)
+RETURNS JSONB AS $$
+    SELECT jsonb_agg(
+        CASE WHEN q.requirement_question_id IS NULL THEN e.condition
+             ELSE jsonb_set(e.condition, '{questionId}', to_jsonb(q.requirement_question_id))
+        END
+        ORDER BY e.ord)
+    FROM jsonb_array_elements(conditions) WITH ORDINALITY AS e(condition, ord)
+    LEFT JOIN state_manager.requirement_question_table q
+        ON q.questionnaire_version_id = version_id_input
+       AND q.copied_from_question_id = (e.condition->>'questionId')::INT;
+$$ LANGUAGE sql;
+
+
+-- Finishes an edit of a questionnaire version: remaps conditions onto copied questions,
+-- renumbers positions from 1 and checks that conditions only refer to earlier questions
+-- of the same version.
+CREATE OR REPLACE PROCEDURE state_manager.close_questionnaire_version(
+    version_id_input INT
+) AS $$
+DECLARE
+    bad_question_id INT;
+BEGIN
+    UPDATE state_manager.requirement_question_table
+    SET visible_when = state_manager.remap_conditions(visible_when, version_id_input),
+        required_when = state_manager.remap_conditions(required_when, version_id_input)
+    WHERE questionnaire_version_id = version_id_input
+      AND (visible_when IS NOT NULL OR required_when IS NOT NULL);
+
+    UPDATE state_manager.requirement_question_table q
+    SET position = n.new_position
+    FROM (
+        SELECT requirement_question_id,
+               ROW_NUMBER() OVER (ORDER BY position, requirement_question_id) AS new_position
+        FROM state_manager.requirement_question_table
+        WHERE questionnaire_version_id = version_id_input
+    ) n
+    WHERE q.requirement_question_id = n.requirement_question_id;
+
+    SELECT q.requirement_question_id
+    INTO bad_question_id
+    FROM state_manager.requirement_question_table q
+    CROSS JOIN LATERAL jsonb_array_elements(
+        COALESCE(q.visible_when, '[]'::jsonb) || COALESCE(q.required_when, '[]'::jsonb)
+    ) AS c(condition)
+    WHERE q.questionnaire_version_id = version_id_input
+      AND NOT EXISTS (
+          SELECT 1 FROM state_manager.requirement_question_table p
+          WHERE p.questionnaire_version_id = version_id_input
+            AND p.requirement_question_id = (c.condition->>'questionId')::INT
+            AND p.position < q.position
+      )
+    LIMIT 1;
+
+    IF bad_question_id IS NOT NULL THEN
+        RAISE EXCEPTION 'Question % has a condition on a question that does not come before it', bad_question_id;
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Adds a question to the questionnaire of a requirement type and returns its ID.
+-- A NULL position appends the question at the end.
+CREATE OR REPLACE FUNCTION state_manager.add_question(
+    user_id_input             INT,
+    requirement_type_id_input INT,
+    requirement_question_input VARCHAR,
+    question_type_input       VARCHAR,
+    required_input            BOOLEAN,
+    min_value_input           NUMERIC,
+    max_value_input           NUMERIC,
+    pattern_input             VARCHAR,
+    options_input             JSONB,
+    visible_when_input        JSONB,
+    required_when_input       JSONB,
+    position_input            INT
+)
+RETURNS INT AS $$
+DECLARE
+    version_id      INT;
+    new_question_id INT;
+    new_position    INT;
+BEGIN
+    CALL state_manager.assert_user_role(user_id_input, ARRAY[4]);
+    version_id := state_manager.open_questionnaire_version(user_id_input, requirement_type_id_input);
+
+    SELECT COALESCE(MAX(position), 0) + 1
+    INTO new_position
+    FROM state_manager.requirement_question_table
+    WHERE questionnaire_version_id = version_id;
+
+    IF position_input IS NOT NULL AND position_input < new_position THEN
+        new_position := GREATEST(position_input, 1);
+        UPDATE state_manager.requirement_question_table
+        SET position = position + 1
+        WHERE questionnaire_version_id = version_id
+          AND position >= new_position;
+    END IF;
+
+    INSERT INTO state_manager.requirement_question_table(
+        requirement_question, requirement_type_id, question_type, required, min_value, max_value,
+        pattern, options, visible_when, required_when, questionnaire_version_id, position
+    )
+    VALUES (
+        requirement_question_input, requirement_type_id_input, question_type_input, required_input, min_value_input, max_value_input,
+        NULLIF(pattern_input, ''), options_input, visible_when_input, required_when_input, version_id, new_position
+    )
+    RETURNING requirement_question_id INTO new_question_id;
+
+    CALL state_manager.close_questionnaire_version(version_id);
+    RETURN new_question_id;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Replaces a question of the current questionnaire of its requirement type and returns the
+-- ID it has afterwards, which differs when the questionnaire had to be copied.
+CREATE OR REPLACE FUNCTION state_manager.update_question(
+    user_id_input              INT,
+    requirement_question_id_input INT,
+    requirement_question_input VARCHAR,
+    question_type_input        VARCHAR,
+    required_input             BOOLEAN,
+    min_value_input            NUMERIC,
+    max_value_input            NUMERIC,
+    pattern_input              VARCHAR,
+    options_input              JSONB,
+    visible_when_input         JSONB,
+    required_when_input        JSONB
+)
+RETURNS INT AS $$
+DECLARE
+    type_id     INT;
+    version_id  INT;
+    question_id INT;
+BEGIN
+    CALL state_manager.assert_user_role(user_id_input, ARRAY[4]);
+
+    SELECT rt.requirement_type_id
+    INTO type_id
+    FROM state_manager.requirement_question_table q
+    JOIN state_manager.requirement_type_table rt ON q.questionnaire_version_id = rt.current_version_id
+    WHERE q.requirement_question_id = requirement_question_id_input;
+
+    IF type_id IS NULL THEN
+        RAISE EXCEPTION 'Question % is not part of a current questionnaire', requirement_question_id_input;
+    END IF;
+
+    version_id := state_manager.open_questionnaire_version(user_id_input, type_id);
+
+    UPDATE state_manager.requirement_question_table
+    SET requirement_question = requirement_question_input,
+        question_type = question_type_input,
+        required = required_input,
+        min_value = min_value_input,
+        max_value = max_value_input,
+        pattern = NULLIF(pattern_input, ''),
+        options = options_input,
+        visible_when = visible_when_input,
+        required_when = required_when_input
+    WHERE questionnaire_version_id = version_id
+      AND (requirement_question_id = requirement_question_id_input
+           OR copied_from_question_id = requirement_question_id_input)
+    RETURNING requirement_question_id INTO question_id;
+
+    CALL state_manager.close_questionnaire_version(version_id);
+    RETURN question_id;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Removes a question from the current questionnaire of its requirement type.
+-- Requests answered against earlier versions keep the question.
+CREATE OR REPLACE PROCEDURE state_manager.remove_question(
+    user_id_input                 INT,
+    requirement_question_id_input INT
+) AS $$
+DECLARE
+    type_id    INT;
+    version_id INT;
+BEGIN
+    CALL state_manager.assert_user_role(user_id_input, ARRAY[4]);
+
+    SELECT rt.requirement_type_id
+    INTO type_id
+    FROM state_manager.requirement_question_table q
+    JOIN state_manager.requirement_type_table rt ON q.questionnaire_version_id = rt.current_version_id
+    WHERE q.requirement_question_id = requirement_question_id_input;
+
+    IF type_id IS NULL THEN
+        RAISE EXCEPTION 'Question % is not part of a current questionnaire', requirement_question_id_input;
+    END IF;
+
+    version_id := state_manager.open_questionnaire_version(user_id_input, type_id);
+
+    DELETE FROM state_manager.requirement_question_table
+    WHERE questionnaire_version_id = version_id
+      AND (requirement_question_id = requirement_question_id_input
+           OR copied_from_question_id = requirement_question_id_input);
+
+    CALL state_manager.close_questionnaire_version(version_id);
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Reorders the current questionnaire of a requirement type.
+-- question_ids_input must list every question of the current questionnaire exactly once.
+CREATE OR REPLACE PROCEDURE state_manager.reorder_questions(
+    user_id_input             INT,
+    requirement_type_id_input INT,
+    question_ids_input        INT[]
+) AS $$
+DECLARE
+    old_version_id INT;
+    version_id     INT;
+BEGIN
+    CALL state_manager.assert_user_role(user_id_input, ARRAY[4]);
+
+    SELECT current_version_id
+    INTO old_version_id
+    FROM state_manager.requirement_type_table
+    WHERE requirement_type_id = requirement_type_id_input;
+
+    IF (SELECT array_agg(requirement_question_id ORDER BY requirement_question_id)
+        FROM state_manager.requirement_question_table
+        WHERE questionnaire_version_id = old_version_id)
+       IS DISTINCT FROM
+       (SELECT array_agg(id ORDER BY id) FROM unnest(question_ids_input) AS id) THEN
+        RAISE EXCEPTION 'Reorder failed: the questions must list every question of requirement type % exactly once', requirement_type_id_input;
+    END IF;
+
+    version_id := state_manager.open_questionnaire_version(user_id_input, requirement_type_id_input);
+
+    UPDATE state_manager.requirement_question_table q
+    SET position = o.ord
+    FROM unnest(question_ids_input) WITH ORDINALITY AS o(id, ord)
+    WHERE q.questionnaire_version_id = version_id
+      AND (q.requirement_question_id = o.id OR q.copied_from_question_id = o.id);
+
+    CALL state_manager.close_questionnaire_version(version_id);
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Maps question IDs of older questionnaire versions onto the question they were copied into
+-- in the current questionnaire of their requirement type, following copied_from_question_id
+-- across versions. Returns a JSON object of old ID to current ID; questions that were removed
+-- since are left out.
+CREATE OR REPLACE FUNCTION state_manager.get_current_question_ids(
+    question_ids_input INT[]
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    WITH RECURSIVE lineage AS (
+        SELECT q.requirement_question_id AS original_id, q.requirement_question_id, q.questionnaire_version_id
+        FROM state_manager.requirement_question_table q
+        WHERE q.requirement_question_id = ANY(question_ids_input)
+        UNION ALL
+        SELECT l.original_id, q.requirement_question_id, q.questionnaire_version_id
+        FROM state_manager.requirement_question_table q
+        JOIN lineage l ON q.copied_from_question_id = l.requirement_question_id
+    )
+    SELECT json_object_agg(l.original_id, l.requirement_question_id)
+    INTO result_json
+    FROM lineage l
+    JOIN state_manager.requirement_type_table rt ON l.questionnaire_version_id = rt.current_version_id;
+
+    IF result_json IS NULL THEN
+        result_json := '{}'::json;
+    END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Full-text search document of each request.
+-- Kept up to date by triggers on the tables it is built from. The 'simple' configuration is
+-- used because most content is Indonesian, which PostgreSQL has no stemmer for.
+-- Internal and deleted comments are left out, so snippets never show them to requesters.
+CREATE TABLE IF NOT EXISTS state_manager.request_search_table (
+    request_id    INT PRIMARY KEY REFERENCES state_manager.request_table(request_id) ON DELETE CASCADE,
+    document      TSVECTOR NOT NULL,
+    document_text TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS request_search_table_document_idx ON state_manager.request_search_table USING GIN (document);
+
+
+-- Rebuilds the search document of a request.
+-- Title weighs most, then the analysis purpose, then remark and answers, then comments and attachment filenames.
+CREATE OR REPLACE FUNCTION state_manager.refresh_request_search(
+    request_id_input INT
+)
+RETURNS VOID AS $$
+DECLARE
+    title_text      TEXT;
+    purpose_text    TEXT;
+    remark_text     TEXT;
+    answers_text    TEXT;
+    comments_text   TEXT;
+    filenames_text  TEXT;
+BEGIN
+    SELECT request_title, analysis_purpose, remark
+    INTO title_text, purpose_text, remark_text
+    FROM state_manager.request_table
+    WHERE request_id = request_id_input;
+
+    IF NOT FOUND THEN
+        DELETE FROM state_manager.request_search_table WHERE request_id = request_id_input;
+        RETURN;
+    END IF;
+
+    SELECT string_agg(answer, ' ')
+    INTO answers_text
+    FROM state_manager.requirement_table
+    WHERE request_id = request_id_input;
+
+    SELECT string_agg(comment_body, ' ' ORDER BY created_at)
+    INTO comments_text
+    FROM state_manager.comment_table
+    WHERE request_id = request_id_input
+      AND NOT internal
+      AND deleted_at IS NULL;
+
+    SELECT string_agg(attachment_filename, ' ')
+    INTO filenames_text
+    FROM state_manager.attachment_table
+    WHERE request_id = request_id_input;
+
+    INSERT INTO state_manager.request_search_table(request_id, document, document_text)
+    VALUES (
+        request_id_input,
+        setweight(to_tsvector('simple', COALESCE(title_text, '')), 'A')
+            || setweight(to_tsvector('simple', COALESCE(purpose_text, '')), 'B')
+            || setweight(to_tsvector('simple', COALESCE(remark_text, '') || ' ' || COALESCE(answers_text, '')), 'C')
+            || setweight(to_tsvector('simple', COALESCE(comments_text, '') || ' ' || COALESCE(filenames_text, '')), 'D'),
+        concat_ws(' ', title_text, purpose_text, remark_text, answers_text, comments_text, filenames_text)
+    )
+    ON CONFLICT (request_id) DO UPDATE
+    SET document = EXCLUDED.document,
+        document_text = EXCLUDED.document_text;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Refreshes the search document of the request a changed row belongs to.
+CREATE OR REPLACE FUNCTION state_manager.request_search_trigger()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        PERFORM state_manager.refresh_request_search(OLD.request_id);
+    ELSE
+        PERFORM state_manager.refresh_request_search(NEW.request_id);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Refreshes the search documents of the requests whose answers a statement changed, once each.
+-- Answers are written a request at a time, so a row-level trigger would rebuild the same
+-- document once per question.
+CREATE OR REPLACE FUNCTION state_manager.request_search_answers_trigger()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        PERFORM state_manager.refresh_request_search(changed.request_id)
+        FROM (SELECT DISTINCT request_id FROM old_rows) changed;
+    ELSE
+        PERFORM state_manager.refresh_request_search(changed.request_id)
+        FROM (SELECT DISTINCT request_id FROM new_rows) changed;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS request_search_request_trigger ON state_manager.request_table;
+CREATE TRIGGER request_search_request_trigger
+    AFTER INSERT OR UPDATE OF request_title, analysis_purpose, remark ON state_manager.request_table
+    FOR EACH ROW EXECUTE FUNCTION state_manager.request_search_trigger();
+
+-- Transition tables allow a single event per trigger.
+DROP TRIGGER IF EXISTS request_search_answer_trigger ON state_manager.requirement_table;
+DROP TRIGGER IF EXISTS request_search_answer_insert_trigger ON state_manager.requirement_table;
+CREATE TRIGGER request_search_answer_insert_trigger
+    AFTER INSERT ON state_manager.requirement_table
+    REFERENCING NEW TABLE AS new_rows
+    FOR EACH STATEMENT EXECUTE FUNCTION state_manager.request_search_answers_trigger();
+
+DROP TRIGGER IF EXISTS request_search_answer_update_trigger ON state_manager.requirement_table;
+CREATE TRIGGER request_search_answer_update_trigger
+    AFTER UPDATE ON state_manager.requirement_table
+    REFERENCING NEW TABLE AS new_rows
+    FOR EACH STATEMENT EXECUTE FUNCTION state_manager.request_search_answers_trigger();
+
+DROP TRIGGER IF EXISTS request_search_answer_delete_trigger ON state_manager.requirement_table;
+CREATE TRIGGER request_search_answer_delete_trigger
+    AFTER DELETE ON state_manager.requirement_table
+    REFERENCING OLD TABLE AS old_rows
+    FOR EACH STATEMENT EXECUTE FUNCTION state_manager.request_search_answers_trigger();
+
+DROP TRIGGER IF EXISTS request_search_comment_trigger ON state_manager.comment_table;
+CREATE TRIGGER request_search_comment_trigger
+    AFTER INSERT OR UPDATE OR DELETE ON state_manager.comment_table
+    FOR EACH ROW EXECUTE FUNCTION state_manager.request_search_trigger();
+
+DROP TRIGGER IF EXISTS request_search_attachment_trigger ON state_manager.attachment_table;
+CREATE TRIGGER request_search_attachment_trigger
+    AFTER INSERT OR UPDATE OR DELETE ON state_manager.attachment_table
+    FOR EACH ROW EXECUTE FUNCTION state_manager.request_search_trigger();
+
+-- Index the requests that existed before search was added.
+SELECT state_manager.refresh_request_search(request_id)
+FROM state_manager.request_table
+WHERE request_id NOT IN (SELECT request_id FROM state_manager.request_search_table);
+
+
+-- Searches the requests a user may see, best match first.
+-- Staff search every request, other users only their own. Every filter is optional.
+-- Snippets mark matches with U+E000 and U+E001 so the caller can escape the text around them.
+CREATE OR REPLACE FUNCTION state_manager.search_requests(
+    user_id_input              INT,
+    query_input                TEXT,
+    state_ids_input            INT[],
+    requirement_type_ids_input INT[],
+    requester_id_input         INT,
+    urgent_input               BOOLEAN,
+    date_from_input            TIMESTAMP,
+    date_to_input              TIMESTAMP,
+    limit_input                INT,
+    offset_input               INT
+)
+RETURNS JSON AS $$
+DECLARE
+    staff       BOOLEAN;
+    search_query TSQUERY;
+    total_count BIGINT;
+    result_json JSON;
+BEGIN
+    staff := state_manager.is_staff(user_id_input);
+    search_query := websearch_to_tsquery('simple', query_input);
+
+    -- The matches are computed once and shared by the count and the page.
+    -- Headlines are only computed for the returned page, they are the expensive part.
+    WITH search_match AS (
+        SELECT r.request_id, ts_rank_cd(rs.document, search_query) AS rank
+        FROM state_manager.request_search_table rs
+        JOIN state_manager.request_table r ON rs.request_id = r.request_id
+        WHERE rs.document @@ search_query
+          AND (staff OR r.user_id = user_id_input)
+          AND (state_ids_input IS NULL OR r.current_state = ANY(state_ids_input))
+          AND (requirement_type_ids_input IS NULL OR r.requirement_type_id = ANY(requirement_type_ids_input))
+          AND (requester_id_input IS NULL OR r.user_id = requester_id_input)
+          AND (urgent_input IS NULL OR r.urgent = urgent_input)
+          AND (date_from_input IS NULL OR r.request_date >= date_from_input)
+          AND (date_to_input IS NULL OR r.request_date < date_to_input)
+    )
+    SELECT
+        (SELECT COUNT(*) FROM search_match),
+        (
+            SELECT json_agg(row_to_json(t))
+            FROM (
+                SELECT
+                    r.request_id AS "requestId",
+                    r.request_title AS "requestTitle",
+                    r.requester_name AS "requesterName",
+                    r.request_date AS "requestDate",
+                    r.urgent,
+                    rt.data_type_name AS "dataTypeName",
+                    n.state_name AS "stateName",
+                    n.state_name_id AS "stateNameId",
+                    m.rank,
+                    ts_headline('simple', rs.document_text, search_query,
+                        'StartSel=' || chr(57344) || ', StopSel=' || chr(57345) || ', MaxFragments=2, MaxWords=20, MinWords=5, FragmentDelimiter=" … "') AS snippet
+                FROM (
+                    SELECT request_id, rank
+                    FROM search_match
+                    ORDER BY rank DESC, request_id DESC
+                    LIMIT limit_input OFFSET offset_input
+                ) m
+                JOIN state_manager.request_table r ON m.request_id = r.request_id
+                JOIN state_manager.request_search_table rs ON m.request_id = rs.request_id
+                JOIN state_manager.state_name_table n ON r.current_state = n.state_name_id
+                JOIN state_manager.requirement_type_table rt ON r.requirement_type_id = rt.requirement_type_id
+                ORDER BY m.rank DESC, r.request_id DESC
+            ) t
+        )
+    INTO total_count, result_json;
+
+    RETURN json_build_object(
+        'total', total_count,
+        'results', COALESCE(result_json, '[]'::json)
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Lists requests with composable filters, a sort field and keyset pagination.
+-- Every filter is optional. Without a viewer there is no visibility restriction, which the
+-- list presets rely on; with one, staff see every request and other users only their own.
+-- Each request is listed with its latest entry of state_entry_input when given, of its current
+-- state otherwise. sort_input is one of REQUEST_DATE, FINISH_DATE, TIME_IN_STATE, URGENCY or STATE.
+-- The cursor is the sortKey and sortId of the last request of the previous page, a NULL limit
+-- returns every request. Requests without a sort value, e.g. without a requested finish date,
+-- get a sentinel key that sorts them last in either order, so every key can be compared.
+-- TIME_IN_STATE sorts by when the request entered the state, latest first, which keeps the keys
+-- from drifting with the clock between pages.
+CREATE OR REPLACE FUNCTION state_manager.list_requests(
+    viewer_id_input            INT,
+    state_ids_input            INT[],
+    state_entry_input          INT,
+    requirement_type_ids_input INT[],
+    requester_id_input         INT,
+    assignee_id_input          INT,
+    urgent_input               BOOLEAN,
+    date_from_input            TIMESTAMP,
+    date_to_input              TIMESTAMP,
+    min_hours_in_state_input   NUMERIC,
+    sort_input                 VARCHAR,
+    descending_input           BOOLEAN,
+    cursor_key_input           NUMERIC,
+    cursor_id_input            INT,
+    limit_input                INT
+)
+RETURNS JSON AS $$
+DECLARE
+    staff       BOOLEAN;
+    direction   INT;
+    total_count BIGINT;
+    items_json  JSON;
+    next_cursor JSON;
+BEGIN
+    staff := viewer_id_input IS NULL OR state_manager.is_staff(viewer_id_input);
+    -- Descending order sorts the negated keys ascending, so one cursor comparison serves both.
+    direction := CASE WHEN descending_input THEN -1 ELSE 1 END;
+
+    WITH matched AS (
+        SELECT
+            r.request_id AS "requestId",
+            r.request_title AS "requestTitle",
+            r.request_date AS "requestDate",
+            r.requested_completed_date AS "requestedCompletedDate",
+            r.urgent,
+            r.requirement_type_id AS "requirementTypeId",
+            rt.data_type_name AS "dataTypeName",
+            r.user_id AS "userId",
+            u.user_name AS "userName",
+            r.current_state AS "currentState",
+            n2.state_name AS "currentStateName",
+            s.state_name_id AS "stateNameId",
+            n.state_name AS "stateName",
+            s.date_start AS "dateStart",
+            s.date_end AS "dateEnd",
+            u2.user_name AS "startedBy",
+            u3.user_name AS "endedBy",
+            s.completed,
+            s.state_comment AS "stateComment",
+            r.assignee_id AS "assigneeId",
+            ua.user_name AS "assigneeName",
+            s.hours_in_state AS "hoursInState",
+            COALESCE(direction * (CASE sort_input
+                WHEN 'FINISH_DATE' THEN EXTRACT(EPOCH FROM r.requested_completed_date)
+                WHEN 'TIME_IN_STATE' THEN -EXTRACT(EPOCH FROM s.date_start)
+                WHEN 'URGENCY' THEN CASE WHEN r.urgent THEN 1 ELSE 0 END
+                WHEN 'STATE' THEN r.current_state
+                ELSE EXTRACT(EPOCH FROM r.request_date)
+            END)::NUMERIC, 1e18) AS "sortKey",
+            direction * r.request_id AS "sortId"
+        FROM state_manager.request_table r
+        -- A request can enter the same state more than once, only its latest entry is listed.
+        CROSS JOIN LATERAL (
+            SELECT st.*,
+                   ROUND((EXTRACT(EPOCH FROM COALESCE(st.date_end, CURRENT_TIMESTAMP) - st.date_start) / 3600)::NUMERIC, 2) AS hours_in_state
+            FROM state_manager.state_table st
+            WHERE st.request_id = r.request_id
+              AND st.state_name_id = COALESCE(state_entry_input, r.current_state)
+            ORDER BY st.date_start DESC
+            LIMIT 1
+        ) s
+        JOIN state_manager.user_table u ON r.user_id = u.user_id
+        JOIN state_manager.requirement_type_table rt ON r.requirement_type_id = rt.requirement_type_id
+        LEFT JOIN state_manager.state_name_table n ON s.state_name_id = n.state_name_id
+        LEFT JOIN state_manager.state_name_table n2 ON r.current_state = n2.state_name_id
+        LEFT JOIN state_manager.user_table u2 ON s.started_by = u2.user_id
+        LEFT JOIN state_manager.user_table u3 ON s.ended_by = u3.user_id
+        LEFT JOIN state_manager.user_table ua ON r.assignee_id = ua.user_id
+        WHERE (staff OR r.user_id = viewer_id_input)
+          AND (state_ids_input IS NULL OR r.current_state = ANY(state_ids_input))
+          AND (requirement_type_ids_input IS NULL OR r.requirement_type_id = ANY(requirement_type_ids_input))
+          AND (requester_id_input IS NULL OR r.user_id = requester_id_input)
+          AND (assignee_id_input IS NULL OR r.assignee_id = assignee_id_input)
+          AND (urgent_input IS NULL OR r.urgent = urgent_input)
+          AND (date_from_input IS NULL OR r.request_date >= date_from_input)
+          AND (date_to_input IS NULL OR r.request_date <= date_to_input)
+          AND (min_hours_in_state_input IS NULL OR s.hours_in_state >= min_hours_in_state_input)
+    ),
+    page AS (
+        SELECT m.*, ROW_NUMBER() OVER (ORDER BY m."sortKey", m."sortId") AS page_row
+        FROM matched m
+        WHERE cursor_key_input IS NULL
+           OR (m."sortKey", m."sortId") > (cursor_key_input, cursor_id_input)
+        ORDER BY m."sortKey", m."sortId"
+        -- One extra row tells whether there is a next page.
+        LIMIT limit_input + 1
+    )
+    SELECT
+        (SELECT COUNT(*) FROM matched),
+        (SELECT json_agg(to_jsonb(p) - 'page_row' ORDER BY p.page_row)
+         FROM page p
+         WHERE limit_input IS NULL OR p.page_row <= limit_input),
+        (SELECT json_build_object('sortKey', p."sortKey", 'sortId', p."sortId")
+         FROM page p
+         WHERE p.page_row = limit_input
+           AND EXISTS (SELECT 1 FROM page WHERE page_row > limit_input))
+    INTO total_count, items_json, next_cursor;
+
+    RETURN json_build_object(
+        'total', total_count,
+        'items', COALESCE(items_json, '[]'::json),
+        'nextCursor', next_cursor
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Saved views: named filter and sort combinations of the request listing.
+-- filter holds the listing filter as sent by the API (see list_requests). A view is private
+-- to its owner unless it is shared with a role, whose members can then load it too.
+CREATE TABLE IF NOT EXISTS state_manager.saved_view_table (
+    view_id        SERIAL PRIMARY KEY,
+    user_id        INT NOT NULL REFERENCES state_manager.user_table(user_id),
+    view_name      VARCHAR(100) NOT NULL,
+    filter         JSONB NOT NULL DEFAULT '{}'::jsonb,
+    shared_role_id INT REFERENCES state_manager.role_table(role_id),
+    created_at     TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at     TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS saved_view_table_user_id_idx ON state_manager.saved_view_table(user_id);
+
+
+-- Returns the saved views a user may load: their own and those shared with one of their roles.
+CREATE OR REPLACE FUNCTION state_manager.get_saved_views(
+    user_id_input INT
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    SELECT json_agg(row_to_json(t))
+    INTO result_json
+    FROM (
+        SELECT
+            v.view_id AS "viewId",
+            v.view_name AS "viewName",
+            v.filter,
+            v.shared_role_id AS "sharedRoleId",
+            v.user_id AS "ownerId",
+            u.user_name AS "ownerName",
+            v.user_id = user_id_input AS "owned",
+            v.updated_at AS "updatedAt"
+        FROM state_manager.saved_view_table v
+        JOIN state_manager.user_table u ON v.user_id = u.user_id
+        WHERE v.user_id = user_id_input
+           OR v.shared_role_id IN (
+               SELECT role_id FROM state_manager.user_role_table WHERE user_id = user_id_input
+           )
+        ORDER BY v.user_id = user_id_input DESC, v.view_name
+    ) t;
+
+    IF result_json IS NULL THEN
+        result_json := '[]'::json;
+    END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Returns a saved view the user may load as a JSON object, or an empty object otherwise.
+CREATE OR REPLACE FUNCTION state_manager.get_saved_view(
+    view_id_input INT,
+    user_id_input INT
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    SELECT row_to_json(t)
+    INTO result_json
+    FROM (
+        SELECT
+            v.view_id AS "viewId",
+            v.view_name AS "viewName",
+            v.filter,
+            v.shared_role_id AS "sharedRoleId",
+            v.user_id AS "ownerId",
+            v.user_id = user_id_input AS "owned"
+        FROM state_manager.saved_view_table v
+        WHERE v.view_id = view_id_input
+          AND (v.user_id = user_id_input
+               OR v.shared_role_id IN (
+                   SELECT role_id FROM state_manager.user_role_table WHERE user_id = user_id_input
+               ))
+    ) t;
+
+    IF result_json IS NULL THEN
+        result_json := '{}'::json;
+    END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Creates a saved view, or updates one of the user's own views when a view ID is given.
+-- A view can only be shared with a role the owner has.
+CREATE OR REPLACE FUNCTION state_manager.save_view(
+    view_id_input        INT,
+    user_id_input        INT,
+    view_name_input      VARCHAR,
+    filter_input         JSONB,
+    shared_role_id_input INT
+)
+RETURNS JSON AS $$
+DECLARE
+    temp_view_id INT;
+BEGIN
+    IF shared_role_id_input IS NOT NULL THEN
+        CALL state_manager.assert_user_role(user_id_input, ARRAY[shared_role_id_input]);
+    END IF;
+
+    IF view_id_input IS NULL THEN
+        INSERT INTO state_manager.saved_view_table(user_id, view_name, filter, shared_role_id)
+        VALUES (user_id_input, view_name_input, filter_input, shared_role_id_input)
+        RETURNING view_id INTO temp_view_id;
+    ELSE
+        UPDATE state_manager.saved_view_table
+        SET view_name = view_name_input,
+            filter = filter_input,
+            shared_role_id = shared_role_id_input,
+            updated_at = CURRENT_TIMESTAMP
+        WHERE view_id = view_id_input
+          AND user_id = user_id_input
+        RETURNING view_id INTO temp_view_id;
+
+        IF temp_view_id IS NULL THEN
+            RAISE EXCEPTION 'Update failed: view % does not exist or is not owned by user %', view_id_input, user_id_input;
+        END IF;
+    END IF;
+
+    RETURN state_manager.get_saved_view(temp_view_id, user_id_input);
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Deletes one of the user's own saved views. Admins may delete any view.
+CREATE OR REPLACE PROCEDURE state_manager.delete_view(
+    view_id_input INT,
+    user_id_input INT
+) AS $$
+BEGIN
+    DELETE FROM state_manager.saved_view_table
+    WHERE view_id = view_id_input
+      AND (user_id = user_id_input
+           OR EXISTS (
+               SELECT 1 FROM state_manager.user_role_table
+               WHERE user_id = user_id_input AND role_id = 4
+           ));
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Delete failed: view % does not exist or is not owned by user %', view_id_input, user_id_input;
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Email templates, one per notification event.
+-- Each template is rendered with Go's templates: the subject and the plain-text part as text,
+-- the HTML part with html/template so request data is escaped. See EmailData in the API for
+-- the variables a template can use.
+CREATE TABLE IF NOT EXISTS state_manager.email_template_table (
+    event_name    VARCHAR(40) PRIMARY KEY,
+    subject       TEXT NOT NULL,
+    html_body     TEXT NOT NULL,
+    text_body     TEXT NOT NULL,
+    updated_by    INT REFERENCES state_manager.user_table(user_id),
+    updated_at    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- The default templates. Existing templates are kept, so admins' changes survive a rerun.
+INSERT INTO state_manager.email_template_table(event_name, subject, html_body, text_body)
+VALUES
+('SUBMITTED',
+ '[StateManager] Request baru: {{.RequestTitle}} (ID {{.RequestId}})',
+ 'Selamat pagi Bapak/Ibu{{with .RecipientName}} {{.}}{{end}},<br><br>
+Email ini dikirim secara otomatis untuk memberitahukan bahwa terdapat request baru yang menunggu validasi.<br><br>
+Judul: {{.RequestTitle}}<br>
+Pemohon: {{.RequesterName}}<br>
+Jenis data: {{.DataTypeName}}<br>
+Tanggal selesai yang diminta: {{date .RequestedFinishDate}}{{if .Urgent}} (URGENT){{end}}<br><br>
+<a href="{{.Link}}">Buka request</a><br><br>
+Terima kasih atas perhatian dan kerja samanya.<br><br>
+Salam,<br>StateManager',
+ 'Selamat pagi Bapak/Ibu{{with .RecipientName}} {{.}}{{end}},
+
+Email ini dikirim secara otomatis untuk memberitahukan bahwa terdapat request baru yang menunggu validasi.
+
+Judul: {{.RequestTitle}}
+Pemohon: {{.RequesterName}}
+Jenis data: {{.DataTypeName}}
+Tanggal selesai yang diminta: {{date .RequestedFinishDate}}{{if .Urgent}} (URGENT){{end}}
+
+Buka request: {{.Link}}
+
+Terima kasih atas perhatian dan kerja samanya.
+
+Salam,
+StateManager'),
+('VALIDATED',
+ '[StateManager] Request tervalidasi: {{.RequestTitle}} (ID {{.RequestId}})',
+ 'Selamat pagi Bapak/Ibu{{with .RecipientName}} {{.}}{{end}},<br><br>
+Email ini dikirim secara otomatis untuk memberitahukan bahwa request "{{.RequestTitle}}" (ID {{.RequestId}}) telah divalidasi dan siap untuk dikerjakan.<br><br>
+Jenis data: {{.DataTypeName}}<br>
+Tanggal selesai yang diminta: {{date .RequestedFinishDate}}{{if .Urgent}} (URGENT){{end}}<br><br>
+<a href="{{.Link}}">Buka request</a><br><br>
+Mohon dapat dilakukan tindak lanjut terhadap request tersebut.<br><br>
+Terima kasih atas perhatian dan kerja samanya.<br><br>
+Salam,<br>StateManager',
+ 'Selamat pagi Bapak/Ibu{{with .RecipientName}} {{.}}{{end}},
+
+Email ini dikirim secara otomatis untuk memberitahukan bahwa request "{{.RequestTitle}}" (ID {{.RequestId}}) telah divalidasi dan siap untuk dikerjakan.
+
+Jenis data: {{.DataTypeName}}
+Tanggal selesai yang diminta: {{date .RequestedFinishDate}}{{if .Urgent}} (URGENT){{end}}
+
+Buka request: {{.Link}}
+
+Mohon dapat dilakukan tindak lanjut terhadap request tersebut.
+
+Terima kasih atas perhatian dan kerja samanya.
+
+Salam,
+StateManager'),
+('STARTED',
+ '[StateManager] Request mulai dikerjakan: {{.RequestTitle}} (ID {{.RequestId}})',
+ 'Selamat pagi Bapak/Ibu{{with .RecipientName}} {{.}}{{end}},<br><br>
+Email ini dikirim secara otomatis untuk memberitahukan bahwa request "{{.RequestTitle}}" (ID {{.RequestId}}) telah mulai dikerjakan{{with .AssigneeName}} oleh {{.}}{{end}}.<br><br>
+<a href="{{.Link}}">Buka request</a><br><br>
+Terima kasih atas perhatian dan kerja samanya.<br><br>
+Salam,<br>StateManager',
+ 'Selamat pagi Bapak/Ibu{{with .RecipientName}} {{.}}{{end}},
+
+Email ini dikirim secara otomatis untuk memberitahukan bahwa request "{{.RequestTitle}}" (ID {{.RequestId}}) telah mulai dikerjakan{{with .AssigneeName}} oleh {{.}}{{end}}.
+
+Buka request: {{.Link}}
+
+Terima kasih atas perhatian dan kerja samanya.
+
+Salam,
+StateManager'),
+('READY_FOR_REVIEW',
+ '[StateManager] Request menunggu review: {{.RequestTitle}} (ID {{.RequestId}})',
+ 'Selamat pagi Bapak/Ibu{{with .RecipientName}} {{.}}{{end}},<br><br>
+Email ini dikirim secara otomatis untuk memberitahukan bahwa request "{{.RequestTitle}}" (ID {{.RequestId}}) telah selesai dikerjakan{{with .AssigneeName}} oleh {{.}}{{end}} dan menunggu review.<br><br>
+<a href="{{.Link}}">Buka request</a><br><br>
+Mohon dapat dilakukan review terhadap request tersebut.<br><br>
+Terima kasih atas perhatian dan kerja samanya.<br><br>
+Salam,<br>StateManager',
+ 'Selamat pagi Bapak/Ibu{{with .RecipientName}} {{.}}{{end}},
+
+Email ini dikirim secara otomatis untuk memberitahukan bahwa request "{{.RequestTitle}}" (ID {{.RequestId}}) telah selesai dikerjakan{{with .AssigneeName}} oleh {{.}}{{end}} dan menunggu review.
+
+Buka request: {{.Link}}
+
+Mohon dapat dilakukan review terhadap request tersebut.
+
+Terima kasih atas perhatian dan kerja samanya.
+
+Salam,
+StateManager'),
+('REVISION_REQUESTED',
+ '[StateManager] Revisi diminta: {{.RequestTitle}} (ID {{.RequestId}})',
+ 'Selamat pagi Bapak/Ibu{{with .RecipientName}} {{.}}{{end}},<br><br>
+Email ini dikirim secara otomatis untuk memberitahukan bahwa hasil request "{{.RequestTitle}}" (ID {{.RequestId}}) perlu direvisi{{with .ActorName}} menurut {{.}}{{end}}.<br><br>
+{{with .Comment}}Catatan review:<br>{{.}}<br><br>{{end}}
+<a href="{{.Link}}">Buka request</a><br><br>
+Terima kasih atas perhatian dan kerja samanya.<br><br>
+Salam,<br>StateManager',
+ 'Selamat pagi Bapak/Ibu{{with .RecipientName}} {{.}}{{end}},
+
+Email ini dikirim secara otomatis untuk memberitahukan bahwa hasil request "{{.RequestTitle}}" (ID {{.RequestId}}) perlu direvisi{{with .ActorName}} menurut {{.}}{{end}}.
+{{with .Comment}}
+Catatan review:
+{{.}}
+{{end}}
+Buka request: {{.Link}}
+
+Terima kasih atas perhatian dan kerja samanya.
+
+Salam,
+StateManager'),
+('REJECTED',
+ '[StateManager] Request ditolak: {{.RequestTitle}} (ID {{.RequestId}})',
+ 'Selamat pagi Bapak/Ibu{{with .RecipientName}} {{.}}{{end}},<br><br>
+Email ini dikirim secara otomatis untuk memberitahukan bahwa request "{{.RequestTitle}}" (ID {{.RequestId}}) telah di REJECT pada tahap validasi.<br><br>
+{{with .Comment}}Request Bapak/Ibu di reject dikarenakan:<br>{{.}}<br><br>{{end}}
+<a href="{{.Link}}">Buka request</a><br><br>
+Terima kasih atas perhatian dan kerja samanya.<br><br>
+Salam,<br>StateManager',
+ 'Selamat pagi Bapak/Ibu{{with .RecipientName}} {{.}}{{end}},
+
+Email ini dikirim secara otomatis untuk memberitahukan bahwa request "{{.RequestTitle}}" (ID {{.RequestId}}) telah di REJECT pada tahap validasi.
+{{with .Comment}}
+Request Bapak/Ibu di reject dikarenakan:
+{{.}}
+{{end}}
+Buka request: {{.Link}}
+
+Terima kasih atas perhatian dan kerja samanya.
+
+Salam,
+StateManager'),
+('DROPPED',
+ '[StateManager] Request dihentikan: {{.RequestTitle}} (ID {{.RequestId}})',
+ 'Selamat pagi Bapak/Ibu{{with .RecipientName}} {{.}}{{end}},<br><br>
+Email ini dikirim secara otomatis untuk memberitahukan bahwa request "{{.RequestTitle}}" (ID {{.RequestId}}) telah di REJECT dan tidak akan dikerjakan lebih lanjut.<br><br>
+{{with .Comment}}Request Bapak/Ibu di reject dikarenakan:<br>{{.}}<br><br>{{end}}
+<a href="{{.Link}}">Buka request</a><br><br>
+Terima kasih atas perhatian dan kerja samanya.<br><br>
+Salam,<br>StateManager',
+ 'Selamat pagi Bapak/Ibu{{with .RecipientName}} {{.}}{{end}},
+
+Email ini dikirim secara otomatis untuk memberitahukan bahwa request "{{.RequestTitle}}" (ID {{.RequestId}}) telah di REJECT dan tidak akan dikerjakan lebih lanjut.
+{{with .Comment}}
+Request Bapak/Ibu di reject dikarenakan:
+{{.}}
+{{end}}
+Buka request: {{.Link}}
+
+Terima kasih atas perhatian dan kerja samanya.
+
+Salam,
+StateManager'),
+('DONE',
+ '[StateManager] Request selesai: {{.RequestTitle}} (ID {{.RequestId}})',
+ 'Selamat pagi Bapak/Ibu{{with .RecipientName}} {{.}}{{end}},<br><br>
+Email ini dikirim secara otomatis untuk memberitahukan bahwa request "{{.RequestTitle}}" (ID {{.RequestId}}) telah selesai.<br><br>
+<a href="{{.Link}}">Buka request</a><br><br>
+Terima kasih atas perhatian dan kerja samanya.<br><br>
+Salam,<br>StateManager',
+ 'Selamat pagi Bapak/Ibu{{with .RecipientName}} {{.}}{{end}},
+
+Email ini dikirim secara otomatis untuk memberitahukan bahwa request "{{.RequestTitle}}" (ID {{.RequestId}}) telah selesai.
+
+Buka request: {{.Link}}
+
+Terima kasih atas perhatian dan kerja samanya.
+
+Salam,
+StateManager'),
+('SLA_BREACH',
+ '[StateManager] Melewati batas waktu: {{.RequestTitle}} (ID {{.RequestId}})',
+ 'Selamat pagi Bapak/Ibu{{with .RecipientName}} {{.}}{{end}},<br><br>
+Email ini dikirim secara otomatis untuk memberitahukan bahwa request "{{.RequestTitle}}" (ID {{.RequestId}}) telah berada pada status {{.StateName}} selama {{printf "%.0f" .HoursInState}} jam, melewati batas {{.ThresholdHours}} jam.<br><br>
+{{with .AssigneeName}}Ditugaskan kepada: {{.}}<br><br>{{end}}
+<a href="{{.Link}}">Buka request</a><br><br>
+Mohon dapat dilakukan tindak lanjut terhadap request tersebut.<br><br>
+Terima kasih atas perhatian dan kerja samanya.<br><br>
+Salam,<br>StateManager',
+ 'Selamat pagi Bapak/Ibu{{with .RecipientName}} {{.}}{{end}},
+
+Email ini dikirim secara otomatis untuk memberitahukan bahwa request "{{.RequestTitle}}" (ID {{.RequestId}}) telah berada pada status {{.StateName}} selama {{printf "%.0f" .HoursInState}} jam, melewati batas {{.ThresholdHours}} jam.
+{{with .AssigneeName}}
+Ditugaskan kepada: {{.}}
+{{end}}
+Buka request: {{.Link}}
+
+Mohon dapat dilakukan tindak lanjut terhadap request tersebut.
+
+Terima kasih atas perhatian dan kerja samanya.
+
+Salam,
+StateManager'),
+('ASSIGNED',
+ '[StateManager] Request ditugaskan: {{.RequestTitle}} (ID {{.RequestId}})',
+ 'Selamat pagi Bapak/Ibu{{with .RecipientName}} {{.}}{{end}},<br><br>
+Email ini dikirim secara otomatis untuk memberitahukan bahwa request "{{.RequestTitle}}" (ID {{.RequestId}}) dengan status {{.StateName}} telah ditugaskan kepada Bapak/Ibu.<br><br>
+<a href="{{.Link}}">Buka request</a><br><br>
+Mohon dapat dilakukan tindak lanjut terhadap request tersebut.<br><br>
+Terima kasih atas perhatian dan kerja samanya.<br><br>
+Salam,<br>StateManager',
+ 'Selamat pagi Bapak/Ibu{{with .RecipientName}} {{.}}{{end}},
+
+Email ini dikirim secara otomatis untuk memberitahukan bahwa request "{{.RequestTitle}}" (ID {{.RequestId}}) dengan status {{.StateName}} telah ditugaskan kepada Bapak/Ibu.
+
+Buka request: {{.Link}}
+
+Mohon dapat dilakukan tindak lanjut terhadap request tersebut.
+
+Terima kasih atas perhatian dan kerja samanya.
+
+Salam,
+StateManager'),
+('MENTIONED',
+ '[StateManager] {{.ActorName}} menyebut Anda: {{.RequestTitle}} (ID {{.RequestId}})',
+ 'Selamat pagi Bapak/Ibu{{with .RecipientName}} {{.}}{{end}},<br><br>
+Email ini dikirim secara otomatis untuk memberitahukan bahwa {{.ActorName}} menyebut Bapak/Ibu dalam komentar pada request "{{.RequestTitle}}" (ID {{.RequestId}}):<br><br>
+{{.Comment}}<br><br>
+<a href="{{.Link}}">Buka request</a><br><br>
+Terima kasih atas perhatian dan kerja samanya.<br><br>
+Salam,<br>StateManager',
+ 'Selamat pagi Bapak/Ibu{{with .RecipientName}} {{.}}{{end}},
+
+Email ini dikirim secara otomatis untuk memberitahukan bahwa {{.ActorName}} menyebut Bapak/Ibu dalam komentar pada request "{{.RequestTitle}}" (ID {{.RequestId}}):
+
+{{.Comment}}
+
+Buka request: {{.Link}}
+
+Terima kasih atas perhatian dan kerja samanya.
+
+Salam,
+StateManager')
+ON CONFLICT DO NOTHING;
+
+
+-- Email templates have one variant per language.
+ALTER TABLE state_manager.email_template_table
+    ADD COLUMN IF NOT EXISTS locale VARCHAR(10) NOT NULL DEFAULT 'id';
+ALTER TABLE state_manager.email_template_table
+    DROP CONSTRAINT IF EXISTS email_template_table_pkey;
+ALTER TABLE state_manager.email_template_table
+    ADD PRIMARY KEY (event_name, locale);
+
+
+-- The English templates.
+INSERT INTO state_manager.email_template_table(event_name, locale, subject, html_body, text_body)
+VALUES
+('SUBMITTED', 'en',
+ '[StateManager] New request: {{.RequestTitle}} (ID {{.RequestId}})',
+ 'Dear {{with .RecipientName}}{{.}}{{else}}Sir/Madam{{end}},<br><br>
+This is an automated message to let you know that a new request is waiting for validation.<br><br>
+Title: {{.RequestTitle}}<br>
+Requester: {{.RequesterName}}<br>
+Data type: {{.DataTypeName}}<br>
+Requested finish date: {{date .RequestedFinishDate}}{{if .Urgent}} (URGENT){{end}}<br><br>
+<a href="{{.Link}}">Open request</a><br><br>
+Thank you for your attention and cooperation.<br><br>
+Regards,<br>StateManager',
+ 'Dear {{with .RecipientName}}{{.}}{{else}}Sir/Madam{{end}},
+
+This is an automated message to let you know that a new request is waiting for validation.
+
+Title: {{.RequestTitle}}
+Requester: {{.RequesterName}}
+Data type: {{.DataTypeName}}
+Requested finish date: {{date .RequestedFinishDate}}{{if .Urgent}} (URGENT){{end}}
+
+Open request: {{.Link}}
+
+Thank you for your attention and cooperation.
+
+Regards,
+StateManager'),
+('VALIDATED', 'en',
+ '[StateManager] Request validated: {{.RequestTitle}} (ID {{.RequestId}})',
+ 'Dear {{with .RecipientName}}{{.}}{{else}}Sir/Madam{{end}},<br><br>
+This is an automated message to let you know that request "{{.RequestTitle}}" (ID {{.RequestId}}) has been validated and is ready to be worked on.<br><br>
+Data type: {{.DataTypeName}}<br>
+Requested finish date: {{date .RequestedFinishDate}}{{if .Urgent}} (URGENT){{end}}<br><br>
+<a href="{{.Link}}">Open request</a><br><br>
+Please follow up on this request.<br><br>
+Thank you for your attention and cooperation.<br><br>
+Regards,<br>StateManager',
+ 'Dear {{with .RecipientName}}{{.}}{{else}}Sir/Madam{{end}},
+
+This is an automated message to let you know that request "{{.RequestTitle}}" (ID {{.RequestId}}) has been validated and is ready to be worked on.
+
+Data type: {{.DataTypeName}}
+Requested finish date: {{date .RequestedFinishDate}}{{if .Urgent}} (URGENT){{end}}
+
+Open request: {{.Link}}
+
+Please follow up on this request.
+
+Thank you for your attention and cooperation.
+
+Regards,
+StateManager'),
+('STARTED', 'en',
+ '[StateManager] Work started: {{.RequestTitle}} (ID {{.RequestId}})',
+ 'Dear {{with .RecipientName}}{{.}}{{else}}Sir/Madam{{end}},<br><br>
+This is an automated message to let you know that work on request "{{.RequestTitle}}" (ID {{.RequestId}}) has started{{with .AssigneeName}}, handled by {{.}}{{end}}.<br><br>
+<a href="{{.Link}}">Open request</a><br><br>
+Thank you for your attention and cooperation.<br><br>
+Regards,<br>StateManager',
+ 'Dear {{with .RecipientName}}{{.}}{{else}}Sir/Madam{{end}},
+
+This is an automated message to let you know that work on request "{{.RequestTitle}}" (ID {{.RequestId}}) has started{{with .AssigneeName}}, handled by {{.}}{{end}}.
+
+Open request: {{.Link}}
+
+Thank you for your attention and cooperation.
+
+Regards,
+StateManager'),
+('READY_FOR_REVIEW', 'en',
+ '[StateManager] Ready for review: {{.RequestTitle}} (ID {{.RequestId}})',
+ 'Dear {{with .RecipientName}}{{.}}{{else}}Sir/Madam{{end}},<br><br>
+This is an automated message to let you know that request "{{.RequestTitle}}" (ID {{.RequestId}}) has been completed{{with .AssigneeName}} by {{.}}{{end}} and is waiting for review.<br><br>
+<a href="{{.Link}}">Open request</a><br><br>
+Please review this request.<br><br>
+Thank you for your attention and cooperation.<br><br>
+Regards,<br>StateManager',
+ 'Dear {{with .RecipientName}}{{.}}{{else}}Sir/Madam{{end}},
+
+This is an automated message to let you know that request "{{.RequestTitle}}" (ID {{.RequestId}}) has been completed{{with .AssigneeName}} by {{.}}{{end}} and is waiting for review.
+
+Open request: {{.Link}}
+
+Please review this request.
+
+Thank you for your attention and cooperation.
+
+Regards,
+StateManager'),
+('REVISION_REQUESTED', 'en',
+ '[StateManager] Revision requested: {{.RequestTitle}} (ID {{.RequestId}})',
+ 'Dear {{with .RecipientName}}{{.}}{{else}}Sir/Madam{{end}},<br><br>
+This is an automated message to let you know that the result of request "{{.RequestTitle}}" (ID {{.RequestId}}) needs to be revised{{with .ActorName}}, as requested by {{.}}{{end}}.<br><br>
+{{with .Comment}}Review notes:<br>{{.}}<br><br>{{end}}
+<a href="{{.Link}}">Open request</a><br><br>
+Thank you for your attention and cooperation.<br><br>
+Regards,<br>StateManager',
+ 'Dear {{with .RecipientName}}{{.}}{{else}}Sir/Madam{{end}},
+
+This is an automated message to let you know that the result of request "{{.RequestTitle}}" (ID {{.RequestId}}) needs to be revised{{with .ActorName}}, as requested by {{.}}{{end}}.
+{{with .Comment}}
+Review notes:
+{{.}}
+{{end}}
+Open request: {{.Link}}
+
+Thank you for your attention and cooperation.
+
+Regards,
+StateManager'),
+('REJECTED', 'en',
+ '[StateManager] Request rejected: {{.RequestTitle}} (ID {{.RequestId}})',
+ 'Dear {{with .RecipientName}}{{.}}{{else}}Sir/Madam{{end}},<br><br>
+This is an automated message to let you know that request "{{.RequestTitle}}" (ID {{.RequestId}}) was rejected during validation.<br><br>
+{{with .Comment}}Your request was rejected because:<br>{{.}}<br><br>{{end}}
+<a href="{{.Link}}">Open request</a><br><br>
+Thank you for your attention and cooperation.<br><br>
+Regards,<br>StateManager',
+ 'Dear {{with .RecipientName}}{{.}}{{else}}Sir/Madam{{end}},
+
+This is an automated message to let you know that request "{{.RequestTitle}}" (ID {{.RequestId}}) was rejected during validation.
+{{with .Comment}}
+Your request was rejected because:
+{{.}}
+{{end}}
+Open request: {{.Link}}
+
+Thank you for your attention and cooperation.
+
+Regards,
+StateManager'),
+('DROPPED', 'en',
+ '[StateManager] Request dropped: {{.RequestTitle}} (ID {{.RequestId}})',
+ 'Dear {{with .RecipientName}}{{.}}{{else}}Sir/Madam{{end}},<br><br>
+This is an automated message to let you know that request "{{.RequestTitle}}" (ID {{.RequestId}}) has been rejected and will not be worked on any further.<br><br>
+{{with .Comment}}Your request was rejected because:<br>{{.}}<br><br>{{end}}
+<a href="{{.Link}}">Open request</a><br><br>
+Thank you for your attention and cooperation.<br><br>
+Regards,<br>StateManager',
+ 'Dear {{with .RecipientName}}{{.}}{{else}}Sir/Madam{{end}},
+
+This is an automated message to let you know that request "{{.RequestTitle}}" (ID {{.RequestId}}) has been rejected and will not be worked on any further.
+{{with .Comment}}
+Your request was rejected because:
+{{.}}
+{{end}}
+Open request: {{.Link}}
+
+Thank you for your attention and cooperation.
+
+Regards,
+StateManager'),
+('DONE', 'en',
+ '[StateManager] Request done: {{.RequestTitle}} (ID {{.RequestId}})',
+ 'Dear {{with .RecipientName}}{{.}}{{else}}Sir/Madam{{end}},<br><br>
+This is an automated message to let you know that request "{{.RequestTitle}}" (ID {{.RequestId}}) is done.<br><br>
+<a href="{{.Link}}">Open request</a><br><br>
+Thank you for your attention and cooperation.<br><br>
+Regards,<br>StateManager',
+ 'Dear {{with .RecipientName}}{{.}}{{else}}Sir/Madam{{end}},
+
+This is an automated message to let you know that request "{{.RequestTitle}}" (ID {{.RequestId}}) is done.
+
+Open request: {{.Link}}
+
+Thank you for your attention and cooperation.
+
+Regards,
+StateManager'),
+('SLA_BREACH', 'en',
+ '[StateManager] Overdue: {{.RequestTitle}} (ID {{.RequestId}})',
+ 'Dear {{with .RecipientName}}{{.}}{{else}}Sir/Madam{{end}},<br><br>
+This is an automated message to let you know that request "{{.RequestTitle}}" (ID {{.RequestId}}) has been in state {{.StateName}} for {{printf "%.0f" .HoursInState}} hours, exceeding the limit of {{.ThresholdHours}} hours.<br><br>
+{{with .AssigneeName}}Assigned to: {{.}}<br><br>{{end}}
+<a href="{{.Link}}">Open request</a><br><br>
+Please follow up on this request.<br><br>
+Thank you for your attention and cooperation.<br><br>
+Regards,<br>StateManager',
+ 'Dear {{with .RecipientName}}{{.}}{{else}}Sir/Madam{{end}},
+
+This is an automated message to let you know that request "{{.RequestTitle}}" (ID {{.RequestId}}) has been in state {{.StateName}} for {{printf "%.0f" .HoursInState}} hours, exceeding the limit of {{.ThresholdHours}} hours.
+{{with .AssigneeName}}
+Assigned to: {{.}}
+{{end}}
+Open request: {{.Link}}
+
+Please follow up on this request.
+
+Thank you for your attention and cooperation.
+
+Regards,
+StateManager'),
+('ASSIGNED', 'en',
+ '[StateManager] Request assigned to you: {{.RequestTitle}} (ID {{.RequestId}})',
+ 'Dear {{with .RecipientName}}{{.}}{{else}}Sir/Madam{{end}},<br><br>
+This is an automated message to let you know that request "{{.RequestTitle}}" (ID {{.RequestId}}) in state {{.StateName}} has been assigned to you.<br><br>
+<a href="{{.Link}}">Open request</a><br><br>
+Please follow up on this request.<br><br>
+Thank you for your attention and cooperation.<br><br>
+Regards,<br>StateManager',
+ 'Dear {{with .RecipientName}}{{.}}{{else}}Sir/Madam{{end}},
+
+This is an automated message to let you know that request "{{.RequestTitle}}" (ID {{.RequestId}}) in state {{.StateName}} has been assigned to you.
+
+Open request: {{.Link}}
+
+Please follow up on this request.
+
+Thank you for your attention and cooperation.
+
+Regards,
+StateManager'),
+('MENTIONED', 'en',
+ '[StateManager] {{.ActorName}} mentioned you: {{.RequestTitle}} (ID {{.RequestId}})',
+ 'Dear {{with .RecipientName}}{{.}}{{else}}Sir/Madam{{end}},<br><br>
+This is an automated message to let you know that {{.ActorName}} mentioned you in a comment on request "{{.RequestTitle}}" (ID {{.RequestId}}):<br><br>
+{{.Comment}}<br><br>
+<a href="{{.Link}}">Open request</a><br><br>
+Thank you for your attention and cooperation.<br><br>
+Regards,<br>StateManager',
+ 'Dear {{with .RecipientName}}{{.}}{{else}}Sir/Madam{{end}},
+
+This is an automated message to let you know that {{.ActorName}} mentioned you in a comment on request "{{.RequestTitle}}" (ID {{.RequestId}}):
+
+{{.Comment}}
+
+Open request: {{.Link}}
+
+Thank you for your attention and cooperation.
+
+Regards,
+StateManager')
+ON CONFLICT DO NOTHING;
+
+
+-- Returns the template of a notification event in the given language, falling back to the
+-- default language when there is no such variant. Returns an empty object if neither exists.
+DROP FUNCTION IF EXISTS state_manager.get_email_template(VARCHAR);
+CREATE OR REPLACE FUNCTION state_manager.get_email_template(
+    event_name_input     VARCHAR,
+    locale_input         VARCHAR,
+    default_locale_input VARCHAR
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    SELECT row_to_json(t)
+    INTO result_json
+    FROM (
+        SELECT
+            event_name AS "eventName",
+            locale,
+            subject,
+            html_body AS "htmlBody",
+            text_body AS "textBody"
+        FROM state_manager.email_template_table
+        WHERE event_name = event_name_input
+          AND locale IN (locale_input, default_locale_input)
+        ORDER BY locale = locale_input DESC
+        LIMIT 1
+    ) t;
+
+    IF result_json IS NULL THEN
+        result_json := '{}'::json;
+    END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Lists every email template variant for the admin page.
+CREATE OR REPLACE FUNCTION state_manager.get_email_templates(
+    user_id_input INT
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    CALL state_manager.assert_user_role(user_id_input, ARRAY[4]);
+
+    SELECT json_agg(row_to_json(t))
+    INTO result_json
+    FROM (
+        SELECT
+            e.event_name AS "eventName",
+            e.locale,
+            e.subject,
+            e.html_body AS "htmlBody",
+            e.text_body AS "textBody",
+            u.user_name AS "updatedBy",
+            e.updated_at AS "updatedAt"
+        FROM state_manager.email_template_table e
+        LEFT JOIN state_manager.user_table u ON e.updated_by = u.user_id
+        ORDER BY e.event_name, e.locale
+    ) t;
+
+    IF result_json IS NULL THEN
+        result_json := '[]'::json;
+    END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Creates or replaces the template of a notification event in one language. Only admins may
+-- change templates, the API checks that the event and the language are supported.
+DROP PROCEDURE IF EXISTS state_manager.update_email_template(INT, VARCHAR, TEXT, TEXT, TEXT);
+CREATE OR REPLACE PROCEDURE state_manager.update_email_template(
+    user_id_input    INT,
+    event_name_input VARCHAR,
+    locale_input     VARCHAR,
+    subject_input    TEXT,
+    html_body_input  TEXT,
+    text_body_input  TEXT
+) AS $$
+BEGIN
+    CALL state_manager.assert_user_role(user_id_input, ARRAY[4]);
+
+    INSERT INTO state_manager.email_template_table(event_name, locale, subject, html_body, text_body, updated_by)
+    VALUES (event_name_input, locale_input, subject_input, html_body_input, text_body_input, user_id_input)
+    ON CONFLICT (event_name, locale) DO UPDATE
+    SET subject = EXCLUDED.subject,
+        html_body = EXCLUDED.html_body,
+        text_body = EXCLUDED.text_body,
+        updated_by = EXCLUDED.updated_by,
+        updated_at = CURRENT_TIMESTAMP;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Returns the request details an email template can use, or an empty object if there is no such request.
+CREATE OR REPLACE FUNCTION state_manager.get_request_email_data(
+    request_id_input INT
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    SELECT row_to_json(t)
+    INTO result_json
+    FROM (
+        SELECT
+            r.request_id AS "requestId",
+            r.request_title AS "requestTitle",
+            r.requester_name AS "requesterName",
+            r.user_id AS "requesterId",
+            r.analysis_purpose AS "analysisPurpose",
+            r.request_date AS "requestDate",
+            r.requested_completed_date AS "requestedFinishDate",
+            r.urgent,
+            rt.data_type_name AS "dataTypeName",
+            n.state_name AS "stateName",
+            ua.user_name AS "assigneeName"
+        FROM state_manager.request_table r
+        JOIN state_manager.requirement_type_table rt ON r.requirement_type_id = rt.requirement_type_id
+        JOIN state_manager.state_name_table n ON r.current_state = n.state_name_id
+        LEFT JOIN state_manager.user_table ua ON r.assignee_id = ua.user_id
+        WHERE r.request_id = request_id_input
+    ) t;
+
+    IF result_json IS NULL THEN
+        result_json := '{}'::json;
+    END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- SLA breaches that were already notified, so each stay in a state is reported once.
+CREATE TABLE IF NOT EXISTS state_manager.sla_breach_table (
+    request_id    INT NOT NULL REFERENCES state_manager.request_table(request_id) ON DELETE CASCADE,
+    state_name_id INT NOT NULL REFERENCES state_manager.state_name_table(state_name_id),
+    state_started TIMESTAMP NOT NULL,
+    notified_at   TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (request_id, state_name_id, state_started)
+);
+
+
+-- Returns the requests that have been in their current state longer than its threshold and were
+-- not reported yet, and records them as reported.
+CREATE OR REPLACE FUNCTION state_manager.get_new_sla_breaches()
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    WITH breach AS (
+        INSERT INTO state_manager.sla_breach_table(request_id, state_name_id, state_started)
+        SELECT s.request_id, s.state_name_id, s.date_start
+        FROM state_manager.request_table r
+        JOIN state_manager.state_table s
+          ON s.request_id = r.request_id
+         AND s.state_name_id = r.current_state
+         AND s.date_end IS NULL
+        JOIN state_manager.state_threshold_table th ON th.state_name_id = r.current_state
+        WHERE s.date_start < CURRENT_TIMESTAMP - make_interval(hours => th.state_threshold_hour)
+        ON CONFLICT DO NOTHING
+        RETURNING request_id, state_name_id, state_started
+    )
+    SELECT json_agg(row_to_json(t))
+    INTO result_json
+    FROM (
+        SELECT
+            b.request_id AS "requestId",
+            b.state_name_id AS "stateId",
+            r.assignee_id AS "assigneeId",
+            ROUND((EXTRACT(EPOCH FROM CURRENT_TIMESTAMP - b.state_started) / 3600)::NUMERIC, 2) AS "hoursInState",
+            th.state_threshold_hour AS "thresholdHours"
+        FROM breach b
+        JOIN state_manager.request_table r ON b.request_id = r.request_id
+        JOIN state_manager.state_threshold_table th ON th.state_name_id = b.state_name_id
+        ORDER BY b.request_id
+    ) t;
+
+    IF result_json IS NULL THEN
+        result_json := '[]'::json;
+    END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Language of the notifications a user receives, as a lowercase language code.
+-- Users without a template in their language get the default one (Indonesian).
+ALTER TABLE state_manager.user_table
+    ADD COLUMN IF NOT EXISTS locale VARCHAR(10) NOT NULL DEFAULT 'id';
+
+
+-- Sets the language a user receives notifications in.
+CREATE OR REPLACE PROCEDURE state_manager.set_user_locale(
+    user_id_input INT,
+    locale_input  VARCHAR
+) AS $$
+BEGIN
+    UPDATE state_manager.user_table
+    SET locale = locale_input
+    WHERE user_id = user_id_input;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Update failed: user % does not exist', user_id_input;
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Who is notified of each request transition, and with which email template.
+-- recipient_type is ROLE (every user of role_id), USER (user_id), REQUESTER (the owner of the
+-- request) or ASSIGNEE (the analyst holding it). template_event names the email template,
+-- which is usually the transition's own.
+CREATE TABLE IF NOT EXISTS state_manager.notification_rule_table (
+    rule_id        SERIAL PRIMARY KEY,
+    event_name     VARCHAR(40) NOT NULL,
+    recipient_type VARCHAR(20) NOT NULL CHECK (recipient_type IN ('ROLE', 'USER', 'REQUESTER', 'ASSIGNEE')),
+    role_id        INT REFERENCES state_manager.role_table(role_id),
+    user_id        INT REFERENCES state_manager.user_table(user_id),
+    template_event VARCHAR(40) NOT NULL,
+    created_by     INT REFERENCES state_manager.user_table(user_id),
+    created_at     TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CHECK (recipient_type <> 'ROLE' OR role_id IS NOT NULL),
+    CHECK (recipient_type <> 'USER' OR user_id IS NOT NULL)
+);
+
+-- The default rules notify the same people the web app used to.
+INSERT INTO state_manager.notification_rule_table(event_name, recipient_type, role_id, template_event)
+SELECT * FROM (VALUES
+    ('SUBMITTED', 'ROLE', 3, 'SUBMITTED'),
+    ('VALIDATED', 'ROLE', 2, 'VALIDATED'),
+    ('STARTED', 'ROLE', 2, 'STARTED'),
+    ('READY_FOR_REVIEW', 'ROLE', 3, 'READY_FOR_REVIEW'),
+    ('REVISION_REQUESTED', 'ASSIGNEE', NULL, 'REVISION_REQUESTED'),
+    ('REJECTED', 'REQUESTER', NULL, 'REJECTED'),
+    ('DROPPED', 'REQUESTER', NULL, 'DROPPED')
+) AS d(event_name, recipient_type, role_id, template_event)
+WHERE NOT EXISTS (SELECT 1 FROM state_manager.notification_rule_table);
+
+
+-- Returns who to notify of a transition of a request, one row per recipient and template.
+-- A user matched by several rules with the same template is notified once.
+CREATE OR REPLACE FUNCTION state_manager.get_notification_recipients(
+    event_name_input VARCHAR,
+    request_id_input INT
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    SELECT json_agg(row_to_json(t))
+    INTO result_json
+    FROM (
+        SELECT DISTINCT
+            n.template_event AS "template",
+            u.user_id AS "userId",
+            u.user_name AS "userName",
+            u.email,
+            u.locale
+        FROM state_manager.notification_rule_table n
+        JOIN state_manager.request_table r ON r.request_id = request_id_input
+        JOIN state_manager.user_table u ON
+            CASE n.recipient_type
+                WHEN 'ROLE' THEN u.user_id IN (
+                    SELECT ur.user_id FROM state_manager.user_role_table ur WHERE ur.role_id = n.role_id
+                )
+                WHEN 'USER' THEN u.user_id = n.user_id
+                WHEN 'REQUESTER' THEN u.user_id = r.user_id
+                WHEN 'ASSIGNEE' THEN u.user_id = r.assignee_id
+            END
+        WHERE n.event_name = event_name_input
+    ) t;
+
+    IF result_json IS NULL THEN
+        result_json := '[]'::json;
+    END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Lists every notification rule for the admin page.
+CREATE OR REPLACE FUNCTION state_manager.get_notification_rules(
+    user_id_input INT
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    CALL state_manager.assert_user_role(user_id_input, ARRAY[4]);
+
+    SELECT json_agg(row_to_json(t))
+    INTO result_json
+    FROM (
+        SELECT
+            n.rule_id AS "ruleId",
+            n.event_name AS "eventName",
+            n.recipient_type AS "recipientType",
+            n.role_id AS "roleId",
+            n.user_id AS "recipientUserId",
+            u.user_name AS "recipientUserName",
+            n.template_event AS "templateEvent",
+            n.created_at AS "createdAt"
+        FROM state_manager.notification_rule_table n
+        LEFT JOIN state_manager.user_table u ON n.user_id = u.user_id
+        ORDER BY n.event_name, n.rule_id
+    ) t;
+
+    IF result_json IS NULL THEN
+        result_json := '[]'::json;
+    END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Adds a notification rule and returns its ID. Only admins may change notification rules.
+CREATE OR REPLACE FUNCTION state_manager.create_notification_rule(
+    user_id_input           INT,
+    event_name_input        VARCHAR,
+    recipient_type_input    VARCHAR,
+    role_id_input           INT,
+    recipient_user_id_input INT,
+    template_event_input    VARCHAR
+)
+RETURNS INT AS $$
+DECLARE
+    temp_rule_id INT;
+BEGIN
+    CALL state_manager.assert_user_role(user_id_input, ARRAY[4]);
+
+    INSERT INTO state_manager.notification_rule_table(event_name, recipient_type, role_id, user_id, template_event, created_by)
+    VALUES (
+        event_name_input,
+        recipient_type_input,
+        CASE WHEN recipient_type_input = 'ROLE' THEN role_id_input END,
+        CASE WHEN recipient_type_input = 'USER' THEN recipient_user_id_input END,
+        template_event_input,
+        user_id_input
+    )
+    RETURNING rule_id INTO temp_rule_id;
+
+    RETURN temp_rule_id;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Removes a notification rule. Only admins may change notification rules.
+CREATE OR REPLACE PROCEDURE state_manager.delete_notification_rule(
+    user_id_input INT,
+    rule_id_input INT
+) AS $$
+BEGIN
+    CALL state_manager.assert_user_role(user_id_input, ARRAY[4]);
+
+    DELETE FROM state_manager.notification_rule_table
+    WHERE rule_id = rule_id_input;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Delete failed: notification rule % does not exist', rule_id_input;
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Rendered emails waiting to be delivered, written in the same transaction as the change they
+-- report so a notification is never lost or sent for a change that was rolled back.
+-- The delivery worker retries failures with exponential backoff until the attempts run out,
+-- then the email is DEAD until an admin resends it.
+CREATE TABLE IF NOT EXISTS state_manager.email_outbox_table (
+    outbox_id       BIGSERIAL PRIMARY KEY,
+    event_name      VARCHAR(40) NOT NULL,
+    request_id      INT REFERENCES state_manager.request_table(request_id) ON DELETE SET NULL,
+    recipients      TEXT[] NOT NULL,
+    subject         TEXT NOT NULL,
+    html_body       TEXT NOT NULL,
+    text_body       TEXT NOT NULL,
+    status          VARCHAR(10) NOT NULL DEFAULT 'PENDING' CHECK (status IN ('PENDING', 'SENT', 'DEAD')),
+    attempts        INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_error      TEXT,
+    created_at      TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    sent_at         TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS email_outbox_table_due_idx ON state_manager.email_outbox_table(next_attempt_at) WHERE status = 'PENDING';
+
+
+-- Adds a rendered email to the outbox.
+CREATE OR REPLACE PROCEDURE state_manager.queue_email(
+    event_name_input VARCHAR,
+    request_id_input INT,
+    recipients_input TEXT[],
+    subject_input    TEXT,
+    html_body_input  TEXT,
+    text_body_input  TEXT
+) AS $$
+BEGIN
+    INSERT INTO state_manager.email_outbox_table(event_name, request_id, recipients, subject, html_body, text_body)
+    VALUES (event_name_input, request_id_input, recipients_input, subject_input, html_body_input, text_body_input);
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Claims up to limit_input due emails for delivery, oldest first. Claimed emails are pushed back
+-- by lease_seconds_input, so a worker that dies mid-batch only delays them, and concurrent
+-- workers skip each other's claims.
+CREATE OR REPLACE FUNCTION state_manager.claim_outbox_emails(
+    limit_input         INT,
+    lease_seconds_input INT
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    WITH claimed AS (
+        UPDATE state_manager.email_outbox_table o
+        SET next_attempt_at = CURRENT_TIMESTAMP + make_interval(secs => lease_seconds_input)
+        WHERE o.outbox_id IN (
+            SELECT outbox_id
+            FROM state_manager.email_outbox_table
+            WHERE status = 'PENDING'
+              AND next_attempt_at <= CURRENT_TIMESTAMP
+            ORDER BY next_attempt_at, outbox_id
+            LIMIT limit_input
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING o.*
+    )
+    SELECT json_agg(row_to_json(t))
+    INTO result_json
+    FROM (
+        SELECT
+            outbox_id AS "outboxId",
+            event_name AS "eventName",
+            request_id AS "requestId",
+            recipients,
+            subject,
+            html_body AS "htmlBody",
+            text_body AS "textBody",
+            attempts
+        FROM claimed
+        ORDER BY outbox_id
+    ) t;
+
+    IF result_json IS NULL THEN
+        result_json := '[]'::json;
+    END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Records a delivery attempt. Without an error the email is SENT, otherwise it is retried in
+-- retry_seconds_input, or DEAD when that is NULL.
+CREATE OR REPLACE PROCEDURE state_manager.record_outbox_attempt(
+    outbox_id_input     BIGINT,
+    error_input         TEXT,
+    retry_seconds_input INT
+) AS $$
+BEGIN
+    UPDATE state_manager.email_outbox_table
+    SET attempts = attempts + 1,
+        status = CASE
+            WHEN error_input IS NULL THEN 'SENT'
+            WHEN retry_seconds_input IS NULL THEN 'DEAD'
+            ELSE 'PENDING'
+        END,
+        last_error = error_input,
+        next_attempt_at = COALESCE(CURRENT_TIMESTAMP + make_interval(secs => retry_seconds_input), next_attempt_at),
+        sent_at = CASE WHEN error_input IS NULL THEN CURRENT_TIMESTAMP END
+    WHERE outbox_id = outbox_id_input;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Lists outbox emails of a status for the admin page, newest first. The FAILED status lists
+-- the failed deliveries: the DEAD emails and the PENDING ones that already failed at least once.
+CREATE OR REPLACE FUNCTION state_manager.get_outbox_emails(
+    user_id_input INT,
+    status_input  VARCHAR,
+    limit_input   INT
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    CALL state_manager.assert_user_role(user_id_input, ARRAY[4]);
+
+    SELECT json_agg(row_to_json(t))
+    INTO result_json
+    FROM (
+        SELECT
+            outbox_id AS "outboxId",
+            event_name AS "eventName",
+            request_id AS "requestId",
+            recipients,
+            subject,
+            status,
+            attempts,
+            next_attempt_at AS "nextAttemptAt",
+            last_error AS "lastError",
+            created_at AS "createdAt",
+            sent_at AS "sentAt"
+        FROM state_manager.email_outbox_table
+        WHERE CASE status_input
+            WHEN 'FAILED' THEN status = 'DEAD' OR (status = 'PENDING' AND attempts > 0)
+            ELSE status = status_input
+        END
+        ORDER BY created_at DESC, outbox_id DESC
+        LIMIT limit_input
+    ) t;
+
+    IF result_json IS NULL THEN
+        result_json := '[]'::json;
+    END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Puts a DEAD email back in the queue with a fresh set of attempts. Only admins may resend.
+CREATE OR REPLACE PROCEDURE state_manager.resend_outbox_email(
+    user_id_input   INT,
+    outbox_id_input BIGINT
+) AS $$
+BEGIN
+    CALL state_manager.assert_user_role(user_id_input, ARRAY[4]);
+
+    UPDATE state_manager.email_outbox_table
+    SET status = 'PENDING',
+        attempts = 0,
+        next_attempt_at = CURRENT_TIMESTAMP
+    WHERE outbox_id = outbox_id_input
+      AND status = 'DEAD';
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Resend failed: email % does not exist or is not dead', outbox_id_input;
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- How each user wants the emails of each notification event: IMMEDIATE as they happen,
+-- DIGEST to rely on the daily summary instead, or OFF. Events without a row are IMMEDIATE.
+CREATE TABLE IF NOT EXISTS state_manager.notification_preference_table (
+    user_id    INT NOT NULL REFERENCES state_manager.user_table(user_id) ON DELETE CASCADE,
+    event_name VARCHAR(40) NOT NULL,
+    delivery   VARCHAR(10) NOT NULL CHECK (delivery IN ('IMMEDIATE', 'DIGEST', 'OFF')),
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, event_name)
+);
+
+
+-- Returns which of the given users want the emails of an event as they happen.
+CREATE OR REPLACE FUNCTION state_manager.get_immediate_recipients(
+    event_name_input VARCHAR,
+    user_ids_input   INT[]
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    SELECT json_agg(DISTINCT u.user_id)
+    INTO result_json
+    FROM unnest(user_ids_input) AS u(user_id)
+    WHERE NOT EXISTS (
+        SELECT 1
+        FROM state_manager.notification_preference_table p
+        WHERE p.user_id = u.user_id
+          AND p.event_name = event_name_input
+          AND p.delivery <> 'IMMEDIATE'
+    );
+
+    IF result_json IS NULL THEN
+        result_json := '[]'::json;
+    END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Lists the notification preferences a user has set. Events that are not listed are IMMEDIATE.
+CREATE OR REPLACE FUNCTION state_manager.get_notification_preferences(
+    user_id_input INT
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    SELECT json_agg(row_to_json(t))
+    INTO result_json
+    FROM (
+        SELECT
+            event_name AS "eventName",
+            delivery
+        FROM state_manager.notification_preference_table
+        WHERE user_id = user_id_input
+        ORDER BY event_name
+    ) t;
+
+    IF result_json IS NULL THEN
+        result_json := '[]'::json;
+    END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Sets how a user wants the emails of a notification event.
+CREATE OR REPLACE PROCEDURE state_manager.set_notification_preference(
+    user_id_input    INT,
+    event_name_input VARCHAR,
+    delivery_input   VARCHAR
+) AS $$
+BEGIN
+    INSERT INTO state_manager.notification_preference_table(user_id, event_name, delivery)
+    VALUES (user_id_input, event_name_input, delivery_input)
+    ON CONFLICT (user_id, event_name) DO UPDATE
+    SET delivery = EXCLUDED.delivery,
+        updated_at = CURRENT_TIMESTAMP;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- The digest only summarizes the events that put a request on someone's todo list,
+-- the others are sent as they happen again rather than never.
+UPDATE state_manager.notification_preference_table
+SET delivery = 'IMMEDIATE',
+    updated_at = CURRENT_TIMESTAMP
+WHERE delivery = 'DIGEST'
+  AND event_name NOT IN ('SUBMITTED', 'VALIDATED', 'STARTED', 'READY_FOR_REVIEW', 'REVISION_REQUESTED', 'SLA_BREACH', 'ASSIGNED');
+
+-- The day each user was last sent the daily digest.
+ALTER TABLE state_manager.user_table
+    ADD COLUMN IF NOT EXISTS last_digest_on DATE;
+
+-- Returns the users who get the daily digest, everyone with at least one DIGEST preference
+-- who has not been sent today's digest yet, with the roles whose todo list the digest summarizes.
+CREATE OR REPLACE FUNCTION state_manager.get_digest_recipients()
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    SELECT json_agg(row_to_json(t))
+    INTO result_json
+    FROM (
+        SELECT
+            u.user_id AS "userId",
+            u.user_name AS "userName",
+            u.email,
+            u.locale,
+            COALESCE((
+                SELECT json_agg(ur.role_id ORDER BY ur.role_id)
+                FROM state_manager.user_role_table ur
+                WHERE ur.user_id = u.user_id
+            ), '[]'::json) AS "roleIds"
+        FROM state_manager.user_table u
+        WHERE COALESCE(u.email, '') <> ''
+          AND u.last_digest_on IS DISTINCT FROM CURRENT_DATE
+          AND EXISTS (
+              SELECT 1
+              FROM state_manager.notification_preference_table p
+              WHERE p.user_id = u.user_id
+                AND p.delivery = 'DIGEST'
+          )
+        ORDER BY u.user_id
+    ) t;
+
+    IF result_json IS NULL THEN
+        result_json := '[]'::json;
+    END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Records that a user was sent today's digest.
+CREATE OR REPLACE PROCEDURE state_manager.record_digest_sent(
+    user_id_input INT
+) AS $$
+BEGIN
+    UPDATE state_manager.user_table
+    SET last_digest_on = CURRENT_DATE
+    WHERE user_id = user_id_input;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- The daily digest templates. DigestItems are the requests waiting for the recipient,
+-- SlaWarnings those of them close to or past their state's threshold.
+INSERT INTO state_manager.email_template_table(event_name, locale, subject, html_body, text_body)
+VALUES
+('DIGEST', 'id',
+ '[StateManager] Ringkasan harian: {{len .DigestItems}} request menunggu',
+ 'Selamat pagi Bapak/Ibu{{with .RecipientName}} {{.}}{{end}},<br><br>
+Email ini dikirim secara otomatis sebagai ringkasan harian request yang menunggu tindak lanjut Anda.<br><br>
+{{with .SlaWarnings}}<b>Mendekati atau melewati batas waktu:</b><br>
+<ul>{{range .}}<li><a href="{{.Link}}">{{.RequestTitle}}</a> (ID {{.RequestId}}), {{.StateName}} selama {{printf "%.0f" .HoursInState}} dari {{.ThresholdHours}} jam</li>{{end}}</ul>{{end}}
+<b>Menunggu tindak lanjut:</b><br>
+<ul>{{range .DigestItems}}<li><a href="{{.Link}}">{{.RequestTitle}}</a> (ID {{.RequestId}}){{if .Urgent}} [URGENT]{{end}}, {{.StateName}} selama {{printf "%.0f" .HoursInState}} jam</li>{{end}}</ul>
+Terima kasih atas perhatian dan kerja samanya.<br><br>
+Salam,<br>StateManager',
+ 'Selamat pagi Bapak/Ibu{{with .RecipientName}} {{.}}{{end}},
+
+Email ini dikirim secara otomatis sebagai ringkasan harian request yang menunggu tindak lanjut Anda.
+{{with .SlaWarnings}}
+Mendekati atau melewati batas waktu:
+{{range .}}- {{.RequestTitle}} (ID {{.RequestId}}), {{.StateName}} selama {{printf "%.0f" .HoursInState}} dari {{.ThresholdHours}} jam: {{.Link}}
+{{end}}{{end}}
+Menunggu tindak lanjut:
+{{range .DigestItems}}- {{.RequestTitle}} (ID {{.RequestId}}){{if .Urgent}} [URGENT]{{end}}, {{.StateName}} selama {{printf "%.0f" .HoursInState}} jam: {{.Link}}
+{{end}}
+Terima kasih atas perhatian dan kerja samanya.
+
+Salam,
+StateManager'),
+('DIGEST', 'en',
+ '[StateManager] Daily summary: {{len .DigestItems}} requests waiting',
+ 'Dear {{with .RecipientName}}{{.}}{{else}}Sir/Madam{{end}},<br><br>
+This is your automated daily summary of the requests waiting for you.<br><br>
+{{with .SlaWarnings}}<b>Close to or past their time limit:</b><br>
+<ul>{{range .}}<li><a href="{{.Link}}">{{.RequestTitle}}</a> (ID {{.RequestId}}), {{.StateName}} for {{printf "%.0f" .HoursInState}} of {{.ThresholdHours}} hours</li>{{end}}</ul>{{end}}
+<b>Waiting for you:</b><br>
+<ul>{{range .DigestItems}}<li><a href="{{.Link}}">{{.RequestTitle}}</a> (ID {{.RequestId}}){{if .Urgent}} [URGENT]{{end}}, {{.StateName}} for {{printf "%.0f" .HoursInState}} hours</li>{{end}}</ul>
+Thank you for your attention and cooperation.<br><br>
+Regards,<br>StateManager',
+ 'Dear {{with .RecipientName}}{{.}}{{else}}Sir/Madam{{end}},
+
+This is your automated daily summary of the requests waiting for you.
+{{with .SlaWarnings}}
+Close to or past their time limit:
+{{range .}}- {{.RequestTitle}} (ID {{.RequestId}}), {{.StateName}} for {{printf "%.0f" .HoursInState}} of {{.ThresholdHours}} hours: {{.Link}}
+{{end}}{{end}}
+Waiting for you:
+{{range .DigestItems}}- {{.RequestTitle}} (ID {{.RequestId}}){{if .Urgent}} [URGENT]{{end}}, {{.StateName}} for {{printf "%.0f" .HoursInState}} hours: {{.Link}}
+{{end}}
+Thank you for your attention and cooperation.
+
+Regards,
+StateManager')
+ON CONFLICT DO NOTHING;
+
+
+-- In-app notifications, shown in the header's bell. event_name is a transition name or
+-- COMMENTED, MENTIONED or ASSIGNED. body holds the start of the comment, if any.
+CREATE TABLE IF NOT EXISTS state_manager.notification_table (
+    notification_id BIGSERIAL PRIMARY KEY,
+    user_id         INT NOT NULL REFERENCES state_manager.user_table(user_id) ON DELETE CASCADE,
+    event_name      VARCHAR(40) NOT NULL,
+    request_id      INT REFERENCES state_manager.request_table(request_id) ON DELETE CASCADE,
+    actor_id        INT REFERENCES state_manager.user_table(user_id),
+    body            TEXT,
+    created_at      TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    read_at         TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS notification_table_user_id_idx ON state_manager.notification_table(user_id, notification_id DESC);
+-- Keeps the unread count cheap enough to poll.
+CREATE INDEX IF NOT EXISTS notification_table_unread_idx ON state_manager.notification_table(user_id) WHERE read_at IS NULL;
+
+
+-- Notifies each of the given users of an event on a request, except the user who caused it.
+CREATE OR REPLACE PROCEDURE state_manager.add_notifications(
+    user_ids_input   INT[],
+    event_name_input VARCHAR,
+    request_id_input INT,
+    actor_id_input   INT,
+    body_input       TEXT
+) AS $$
+BEGIN
+    INSERT INTO state_manager.notification_table(user_id, event_name, request_id, actor_id, body)
+    SELECT DISTINCT u.user_id, event_name_input, request_id_input, actor_id_input, NULLIF(LEFT(body_input, 200), '')
+    FROM unnest(user_ids_input) AS u(user_id)
+    WHERE u.user_id IS NOT NULL
+      AND u.user_id IS DISTINCT FROM actor_id_input;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Notifies the users a new comment concerns. The mentioned users, already checked to be allowed
+-- to read it, are notified of the mention. The requester, the assignee and the author of the
+-- comment replied to are notified of the comment, unless it is internal and they are not staff.
+CREATE OR REPLACE PROCEDURE state_manager.add_comment_notifications(
+    comment_id_input         INT,
+    mentioned_user_ids_input INT[]
+) AS $$
+DECLARE
+    c         state_manager.comment_table%ROWTYPE;
+    concerned      INT[];
+BEGIN
+    SELECT * INTO c
+    FROM state_manager.comment_table
+    WHERE comment_id = comment_id_input;
+
+    CALL state_manager.add_notifications(mentioned_user_ids_input, 'MENTIONED', c.request_id, c.user_id, c.comment_body);
+
+    SELECT array_agg(DISTINCT u.user_id)
+    INTO concerned
+    FROM (
+        SELECT r.user_id FROM state_manager.request_table r WHERE r.request_id = c.request_id
+        UNION
+        SELECT r.assignee_id FROM state_manager.request_table r WHERE r.request_id = c.request_id
+        UNION
+        SELECT p.user_id FROM state_manager.comment_table p WHERE p.comment_id = c.parent_comment_id
+    ) u
+    WHERE u.user_id IS NOT NULL
+      AND u.user_id <> ALL(COALESCE(mentioned_user_ids_input, ARRAY[]::INT[]))
+      AND (NOT c.internal OR state_manager.is_staff(u.user_id));
+
+    CALL state_manager.add_notifications(concerned, 'COMMENTED', c.request_id, c.user_id, c.comment_body);
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Lists a user's notifications, newest first, optionally only the unread ones.
+-- The cursor is the nextCursor of the previous page, the ID of its last notification.
+CREATE OR REPLACE FUNCTION state_manager.get_notifications(
+    user_id_input     INT,
+    unread_only_input BOOLEAN,
+    cursor_id_input   BIGINT,
+    limit_input       INT
+)
+RETURNS JSON AS $$
+DECLARE
+    items_json  JSON;
+    next_cursor BIGINT;
+BEGIN
+    WITH page AS (
+        SELECT
+            n.notification_id AS "notificationId",
+            n.event_name AS "eventName",
+            n.request_id AS "requestId",
+            r.request_title AS "requestTitle",
+            n.actor_id AS "actorId",
+            a.user_name AS "actorName",
+            n.body,
+            n.created_at AS "createdAt",
+            n.read_at IS NOT NULL AS "read",
+            ROW_NUMBER() OVER (ORDER BY n.notification_id DESC) AS page_row
+        FROM state_manager.notification_table n
+        LEFT JOIN state_manager.request_table r ON n.request_id = r.request_id
+        LEFT JOIN state_manager.user_table a ON n.actor_id = a.user_id
+        WHERE n.user_id = user_id_input
+          AND (NOT unread_only_input OR n.read_at IS NULL)
+          AND (cursor_id_input IS NULL OR n.notification_id < cursor_id_input)
+        ORDER BY n.notification_id DESC
+        -- One extra row tells whether there is a next page.
+        LIMIT limit_input + 1
+    )
+    SELECT
+        (SELECT json_agg(to_jsonb(p) - 'page_row' ORDER BY p.page_row)
+         FROM page p
+         WHERE p.page_row <= limit_input),
+        (SELECT p."notificationId"
+         FROM page p
+         WHERE p.page_row = limit_input
+           AND EXISTS (SELECT 1 FROM page WHERE page_row > limit_input))
+    INTO items_json, next_cursor;
+
+    RETURN json_build_object(
+        'items', COALESCE(items_json, '[]'::json),
+        'nextCursor', next_cursor
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Counts a user's unread notifications.
+CREATE OR REPLACE FUNCTION state_manager.get_unread_notification_count(
+    user_id_input INT
+)
+RETURNS INT AS $$
+BEGIN
+    RETURN (
+        SELECT COUNT(*)
+        FROM state_manager.notification_table
+        WHERE user_id = user_id_input
+          AND read_at IS NULL
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Marks one of a user's notifications as read.
+CREATE OR REPLACE PROCEDURE state_manager.mark_notification_read(
+    user_id_input         INT,
+    notification_id_input BIGINT
+) AS $$
+BEGIN
+    UPDATE state_manager.notification_table
+    SET read_at = COALESCE(read_at, CURRENT_TIMESTAMP)
+    WHERE notification_id = notification_id_input
+      AND user_id = user_id_input;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Update failed: notification % does not exist for user %', notification_id_input, user_id_input;
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Marks all of a user's notifications as read and returns how many were unread.
+CREATE OR REPLACE FUNCTION state_manager.mark_all_notifications_read(
+    user_id_input INT
+)
+RETURNS INT AS $$
+DECLARE
+    marked INT;
+BEGIN
+    UPDATE state_manager.notification_table
+    SET read_at = CURRENT_TIMESTAMP
+    WHERE user_id = user_id_input
+      AND read_at IS NULL;
+
+    GET DIAGNOSTICS marked = ROW_COUNT;
+    RETURN marked;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Request events, kept for a day so an /api/events stream that was cut, e.g. when its function
+-- reached its max duration, can replay what it missed from the Last-Event-ID it reconnects with.
+CREATE TABLE IF NOT EXISTS state_manager.request_event_table (
+    event_id   BIGSERIAL PRIMARY KEY,
+    event      JSONB NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS request_event_table_created_idx ON state_manager.request_event_table(created_at);
+
+
+-- Stores a request event and publishes it, with its eventId, as JSON on the state_manager_events
+-- channel, which every backend instance LISTENs on to feed its /api/events streams.
+-- Notifications are only delivered when the transaction commits, so listeners never see a
+-- change that was rolled back.
+CREATE OR REPLACE PROCEDURE state_manager.publish_request_event(
+    event_input JSONB
+) AS $$
+DECLARE
+    temp_event_id BIGINT;
+BEGIN
+    INSERT INTO state_manager.request_event_table(event)
+    VALUES (event_input)
+    RETURNING event_id INTO temp_event_id;
+
+    PERFORM pg_notify('state_manager_events', (event_input || jsonb_build_object('eventId', temp_event_id))::text);
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Publishes the request events of request and comment changes.
+-- requesterId and internal let the backend filter each event to the users allowed to see it.
+CREATE OR REPLACE FUNCTION state_manager.request_event_trigger()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_TABLE_NAME = 'comment_table' THEN
+        CALL state_manager.publish_request_event(jsonb_build_object(
+            'type', 'comment-added',
+            'requestId', NEW.request_id,
+            'requesterId', (SELECT r.user_id FROM state_manager.request_table r WHERE r.request_id = NEW.request_id),
+            'commentId', NEW.comment_id,
+            'internal', NEW.internal
+        ));
+    ELSIF TG_OP = 'INSERT' THEN
+        CALL state_manager.publish_request_event(jsonb_build_object(
+            'type', 'request-created',
+            'requestId', NEW.request_id,
+            'requesterId', NEW.user_id,
+            'stateId', NEW.current_state
+        ));
+    ELSE
+        IF NEW.current_state IS DISTINCT FROM OLD.current_state THEN
+            CALL state_manager.publish_request_event(jsonb_build_object(
+                'type', 'state-changed',
+                'requestId', NEW.request_id,
+                'requesterId', NEW.user_id,
+                'stateId', NEW.current_state,
+                'previousStateId', OLD.current_state
+            ));
+        END IF;
+        IF NEW.assignee_id IS DISTINCT FROM OLD.assignee_id THEN
+            CALL state_manager.publish_request_event(jsonb_build_object(
+                'type', 'assignment',
+                'requestId', NEW.request_id,
+                'requesterId', NEW.user_id,
+                'stateId', NEW.current_state,
+                'assigneeId', NEW.assignee_id
+            ));
+        END IF;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS request_event_request_trigger ON state_manager.request_table;
+CREATE TRIGGER request_event_request_trigger
+    AFTER INSERT OR UPDATE OF current_state, assignee_id ON state_manager.request_table
+    FOR EACH ROW EXECUTE FUNCTION state_manager.request_event_trigger();
+
+DROP TRIGGER IF EXISTS request_event_comment_trigger ON state_manager.comment_table;
+CREATE TRIGGER request_event_comment_trigger
+    AFTER INSERT ON state_manager.comment_table
+    FOR EACH ROW EXECUTE FUNCTION state_manager.request_event_trigger();
+
+
+-- Returns the events after last_event_id_input, up to limit_input, oldest first, as
+-- {"events": [...], "complete": bool}. Events the client has seen are never sent again.
+-- complete is false when the last event seen was already purged or more than limit_input events
+-- followed it, and the stream has to tell the client to resync instead.
+CREATE OR REPLACE FUNCTION state_manager.get_request_events_since(
+    last_event_id_input BIGINT,
+    limit_input         INT
+)
+RETURNS JSON AS $$
+DECLARE
+    last_created_at TIMESTAMP;
+    result_json     JSON;
+    temp_count      INT;
+BEGIN
+    SELECT created_at INTO last_created_at
+    FROM state_manager.request_event_table
+    WHERE event_id = last_event_id_input;
+
+    IF last_created_at IS NULL THEN
+        RETURN json_build_object('events', '[]'::json, 'complete', FALSE);
+    END IF;
+
+    SELECT json_agg(t.event ORDER BY t.event_id), COUNT(*)
+    INTO result_json, temp_count
+    FROM (
+        SELECT event_id, event || jsonb_build_object('eventId', event_id) AS event
+        FROM state_manager.request_event_table
+        WHERE event_id > last_event_id_input
+        ORDER BY event_id
+        LIMIT limit_input + 1
+    ) t;
+
+    RETURN json_build_object(
+        'events', COALESCE(result_json, '[]'::json),
+        'complete', temp_count <= limit_input
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Deletes the request events older than max_age_hours_input and returns how many were deleted.
+CREATE OR REPLACE FUNCTION state_manager.purge_request_events(
+    max_age_hours_input INT
+)
+RETURNS INT AS $$
+DECLARE
+    temp_count INT;
+BEGIN
+    DELETE FROM state_manager.request_event_table
+    WHERE created_at < CURRENT_TIMESTAMP - make_interval(hours => max_age_hours_input);
+
+    GET DIAGNOSTICS temp_count = ROW_COUNT;
+    RETURN temp_count;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Outgoing webhooks that other tools register to hear about request transitions. event_names
+-- filters the transitions a webhook is sent, and secret signs each payload so the receiver can
+-- check it came from us. Inactive webhooks are not sent new events.
+CREATE TABLE IF NOT EXISTS state_manager.webhook_table (
+    webhook_id  SERIAL PRIMARY KEY,
+    url         TEXT NOT NULL,
+    secret      TEXT NOT NULL,
+    event_names TEXT[] NOT NULL CHECK (cardinality(event_names) > 0),
+    active      BOOLEAN NOT NULL DEFAULT TRUE,
+    created_by  INT REFERENCES state_manager.user_table(user_id),
+    created_at  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+
+-- The delivery log of the webhooks. The payload is the request's complete data bundle as it was
+-- when the transition committed, kept as text so a retry or replay sends the same signed bytes.
+-- Failures are retried with exponential backoff like the email outbox, then the delivery is DEAD.
+-- replay_of links a replay to the delivery it repeats.
+CREATE TABLE IF NOT EXISTS state_manager.webhook_delivery_table (
+    delivery_id      BIGSERIAL PRIMARY KEY,
+    webhook_id       INT NOT NULL REFERENCES state_manager.webhook_table(webhook_id) ON DELETE CASCADE,
+    event_name       VARCHAR(40) NOT NULL,
+    request_id       INT REFERENCES state_manager.request_table(request_id) ON DELETE SET NULL,
+    payload          TEXT NOT NULL,
+    status           VARCHAR(10) NOT NULL DEFAULT 'PENDING' CHECK (status IN ('PENDING', 'SENT', 'DEAD')),
+    attempts         INT NOT NULL DEFAULT 0,
+    next_attempt_at  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_status_code INT,
+    last_error       TEXT,
+    replay_of        BIGINT REFERENCES state_manager.webhook_delivery_table(delivery_id) ON DELETE SET NULL,
+    created_at       TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    delivered_at     TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS webhook_delivery_table_due_idx ON state_manager.webhook_delivery_table(next_attempt_at) WHERE status = 'PENDING';
+CREATE INDEX IF NOT EXISTS webhook_delivery_table_webhook_idx ON state_manager.webhook_delivery_table(webhook_id, created_at DESC);
+
+
+-- Queues a delivery of a transition of a request to every active webhook filtering for it.
+-- Called in the transaction of the transition, so nothing is sent for a change that was rolled back.
+CREATE OR REPLACE PROCEDURE state_manager.queue_webhook_deliveries(
+    event_name_input VARCHAR,
+    request_id_input INT
+) AS $$
+BEGIN
+    INSERT INTO state_manager.webhook_delivery_table(webhook_id, event_name, request_id, payload)
+    SELECT
+        w.webhook_id,
+        event_name_input,
+        request_id_input,
+        state_manager.get_complete_data_of_request_bundle(request_id_input)::TEXT
+    FROM state_manager.webhook_table w
+    WHERE w.active
+      AND event_name_input = ANY(w.event_names);
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Claims up to limit_input due deliveries of active webhooks, oldest first, with the URL and
+-- secret to send them with. Claims work like those of claim_outbox_emails.
+CREATE OR REPLACE FUNCTION state_manager.claim_webhook_deliveries(
+    limit_input         INT,
+    lease_seconds_input INT
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    WITH claimed AS (
+        UPDATE state_manager.webhook_delivery_table d
+        SET next_attempt_at = CURRENT_TIMESTAMP + make_interval(secs => lease_seconds_input)
+        WHERE d.delivery_id IN (
+            SELECT dd.delivery_id
+            FROM state_manager.webhook_delivery_table dd
+            JOIN state_manager.webhook_table w ON w.webhook_id = dd.webhook_id
+            WHERE dd.status = 'PENDING'
+              AND dd.next_attempt_at <= CURRENT_TIMESTAMP
+              AND w.active
+            ORDER BY dd.next_attempt_at, dd.delivery_id
+            LIMIT limit_input
+            FOR UPDATE OF dd SKIP LOCKED
+        )
+        RETURNING d.*
+    )
+    SELECT json_agg(row_to_json(t))
+    INTO result_json
+    FROM (
+        SELECT
+            c.delivery_id AS "deliveryId",
+            c.webhook_id AS "webhookId",
+            w.url,
+            w.secret,
+            c.event_name AS "eventName",
+            c.request_id AS "requestId",
+            c.payload,
+            c.attempts
+        FROM claimed c
+        JOIN state_manager.webhook_table w ON w.webhook_id = c.webhook_id
+        ORDER BY c.delivery_id
+    ) t;
+
+    IF result_json IS NULL THEN
+        result_json := '[]'::json;
+    END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Records a delivery attempt with the receiver's HTTP status code, NULL when it could not be
+-- reached. Without an error the delivery is SENT, otherwise it is retried in retry_seconds_input,
+-- or DEAD when that is NULL.
+CREATE OR REPLACE PROCEDURE state_manager.record_webhook_attempt(
+    delivery_id_input   BIGINT,
+    status_code_input   INT,
+    error_input         TEXT,
+    retry_seconds_input INT
+) AS $$
+BEGIN
+    UPDATE state_manager.webhook_delivery_table
+    SET attempts = attempts + 1,
+        status = CASE
+            WHEN error_input IS NULL THEN 'SENT'
+            WHEN retry_seconds_input IS NULL THEN 'DEAD'
+            ELSE 'PENDING'
+        END,
+        last_status_code = status_code_input,
+        last_error = error_input,
+        next_attempt_at = COALESCE(CURRENT_TIMESTAMP + make_interval(secs => retry_seconds_input), next_attempt_at),
+        delivered_at = CASE WHEN error_input IS NULL THEN CURRENT_TIMESTAMP END
+    WHERE delivery_id = delivery_id_input;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Lists every webhook for the admin page, without its secret.
+CREATE OR REPLACE FUNCTION state_manager.get_webhooks(
+    user_id_input INT
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    CALL state_manager.assert_user_role(user_id_input, ARRAY[4]);
+
+    SELECT json_agg(row_to_json(t))
+    INTO result_json
+    FROM (
+        SELECT
+            w.webhook_id AS "webhookId",
+            w.url,
+            w.event_names AS "eventNames",
+            w.active,
+            w.created_at AS "createdAt",
+            (
+                SELECT COUNT(*)
+                FROM state_manager.webhook_delivery_table d
+                WHERE d.webhook_id = w.webhook_id
+                  AND (d.status = 'DEAD' OR (d.status = 'PENDING' AND d.attempts > 0))
+            ) AS "failedDeliveries"
+        FROM state_manager.webhook_table w
+        ORDER BY w.webhook_id
+    ) t;
+
+    IF result_json IS NULL THEN
+        result_json := '[]'::json;
+    END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Registers a webhook and returns its ID. Only admins may change webhooks.
+CREATE OR REPLACE FUNCTION state_manager.create_webhook(
+    user_id_input     INT,
+    url_input         TEXT,
+    secret_input      TEXT,
+    event_names_input TEXT[]
+)
+RETURNS INT AS $$
+DECLARE
+    temp_webhook_id INT;
+BEGIN
+    CALL state_manager.assert_user_role(user_id_input, ARRAY[4]);
+
+    INSERT INTO state_manager.webhook_table(url, secret, event_names, created_by)
+    VALUES (url_input, secret_input, event_names_input, user_id_input)
+    RETURNING webhook_id INTO temp_webhook_id;
+
+    RETURN temp_webhook_id;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Changes the URL, event filter and active flag of a webhook. The secret is kept.
+-- Only admins may change webhooks.
+CREATE OR REPLACE PROCEDURE state_manager.update_webhook(
+    user_id_input     INT,
+    webhook_id_input  INT,
+    url_input         TEXT,
+    event_names_input TEXT[],
+    active_input      BOOLEAN
+) AS $$
+BEGIN
+    CALL state_manager.assert_user_role(user_id_input, ARRAY[4]);
+
+    UPDATE state_manager.webhook_table
+    SET url = url_input,
+        event_names = event_names_input,
+        active = active_input
+    WHERE webhook_id = webhook_id_input;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Update failed: webhook % does not exist', webhook_id_input;
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Removes a webhook together with its delivery log. Only admins may change webhooks.
+CREATE OR REPLACE PROCEDURE state_manager.delete_webhook(
+    user_id_input    INT,
+    webhook_id_input INT
+) AS $$
+BEGIN
+    CALL state_manager.assert_user_role(user_id_input, ARRAY[4]);
+
+    DELETE FROM state_manager.webhook_table
+    WHERE webhook_id = webhook_id_input;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Delete failed: webhook % does not exist', webhook_id_input;
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Lists the delivery log of a webhook, newest first. The status filters like get_outbox_emails,
+-- NULL lists every delivery.
+CREATE OR REPLACE FUNCTION state_manager.get_webhook_deliveries(
+    user_id_input    INT,
+    webhook_id_input INT,
+    status_input     VARCHAR,
+    limit_input      INT
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    CALL state_manager.assert_user_role(user_id_input, ARRAY[4]);
+
+    SELECT json_agg(row_to_json(t))
+    INTO result_json
+    FROM (
+        SELECT
+            delivery_id AS "deliveryId",
+            event_name AS "eventName",
+            request_id AS "requestId",
+            status,
+            attempts,
+            next_attempt_at AS "nextAttemptAt",
+            last_status_code AS "lastStatusCode",
+            last_error AS "lastError",
+            replay_of AS "replayOf",
+            created_at AS "createdAt",
+            delivered_at AS "deliveredAt"
+        FROM state_manager.webhook_delivery_table
+        WHERE webhook_id = webhook_id_input
+          AND CASE status_input
+            WHEN 'FAILED' THEN status = 'DEAD' OR (status = 'PENDING' AND attempts > 0)
+            ELSE status_input IS NULL OR status = status_input
+          END
+        ORDER BY created_at DESC, delivery_id DESC
+        LIMIT limit_input
+    ) t;
+
+    IF result_json IS NULL THEN
+        result_json := '[]'::json;
+    END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Queues a delivery again with the same payload, as a new entry of the log, and returns its ID.
+-- Any delivery can be replayed, e.g. to a receiver that lost what it was sent. Only admins may replay.
+CREATE OR REPLACE FUNCTION state_manager.replay_webhook_delivery(
+    user_id_input     INT,
+    delivery_id_input BIGINT
+)
+RETURNS BIGINT AS $$
+DECLARE
+    temp_delivery_id BIGINT;
+BEGIN
+    CALL state_manager.assert_user_role(user_id_input, ARRAY[4]);
+
+    INSERT INTO state_manager.webhook_delivery_table(webhook_id, event_name, request_id, payload, replay_of)
+    SELECT webhook_id, event_name, request_id, payload, delivery_id
+    FROM state_manager.webhook_delivery_table
+    WHERE delivery_id = delivery_id_input
+    RETURNING delivery_id INTO temp_delivery_id;
+
+    IF temp_delivery_id IS NULL THEN
+        RAISE EXCEPTION 'Replay failed: webhook delivery % does not exist', delivery_id_input;
+    END IF;
+    RETURN temp_delivery_id;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Chat channels that get a role's notifications, posted to an incoming-webhook URL of a Slack,
+-- Microsoft Teams or Mattermost channel. Messages are written in the channel's locale.
+CREATE TABLE IF NOT EXISTS state_manager.role_chat_channel_table (
+    channel_id SERIAL PRIMARY KEY,
+    role_id    INT NOT NULL REFERENCES state_manager.role_table(role_id),
+    kind       VARCHAR(20) NOT NULL CHECK (kind IN ('SLACK', 'TEAMS', 'MATTERMOST')),
+    url        TEXT NOT NULL,
+    locale     VARCHAR(10) NOT NULL DEFAULT 'id',
+    created_by INT REFERENCES state_manager.user_table(user_id),
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+
+-- Chat messages waiting to be posted, queued in the transaction of the change they report like
+-- the email outbox, and retried the same way. message holds the channel-neutral message, which
+-- the backend formats for the channel's kind when posting it.
+CREATE TABLE IF NOT EXISTS state_manager.chat_outbox_table (
+    message_id      BIGSERIAL PRIMARY KEY,
+    channel_id      INT NOT NULL REFERENCES state_manager.role_chat_channel_table(channel_id) ON DELETE CASCADE,
+    event_name      VARCHAR(40) NOT NULL,
+    request_id      INT REFERENCES state_manager.request_table(request_id) ON DELETE SET NULL,
+    message         JSONB NOT NULL,
+    status          VARCHAR(10) NOT NULL DEFAULT 'PENDING' CHECK (status IN ('PENDING', 'SENT', 'DEAD')),
+    attempts        INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_error      TEXT,
+    created_at      TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    sent_at         TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS chat_outbox_table_due_idx ON state_manager.chat_outbox_table(next_attempt_at) WHERE status = 'PENDING';
+
+
+-- Returns the roles the notification rules of a transition notify as a whole, as a JSON array of IDs.
+CREATE OR REPLACE FUNCTION state_manager.get_notification_roles(
+    event_name_input VARCHAR
+)
+RETURNS JSON AS $$
+BEGIN
+    RETURN COALESCE((
+        SELECT json_agg(DISTINCT role_id)
+        FROM state_manager.notification_rule_table
+        WHERE event_name = event_name_input
+          AND recipient_type = 'ROLE'
+    ), '[]'::json);
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Returns the chat channels of the given roles. A channel is listed once.
+CREATE OR REPLACE FUNCTION state_manager.get_role_chat_channels(
+    role_ids_input INT[]
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    SELECT json_agg(row_to_json(t))
+    INTO result_json
+    FROM (
+        SELECT
+            channel_id AS "channelId",
+            locale
+        FROM state_manager.role_chat_channel_table
+        WHERE role_id = ANY(role_ids_input)
+        ORDER BY channel_id
+    ) t;
+
+    IF result_json IS NULL THEN
+        result_json := '[]'::json;
+    END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Adds a chat message for a channel to the outbox.
+CREATE OR REPLACE PROCEDURE state_manager.queue_chat_message(
+    channel_id_input INT,
+    event_name_input VARCHAR,
+    request_id_input INT,
+    message_input    JSONB
+) AS $$
+BEGIN
+    INSERT INTO state_manager.chat_outbox_table(channel_id, event_name, request_id, message)
+    VALUES (channel_id_input, event_name_input, request_id_input, message_input);
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Claims up to limit_input due chat messages for posting, oldest first, with the kind and URL
+-- of their channel. Claims work like those of claim_outbox_emails.
+CREATE OR REPLACE FUNCTION state_manager.claim_chat_messages(
+    limit_input         INT,
+    lease_seconds_input INT
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    WITH claimed AS (
+        UPDATE state_manager.chat_outbox_table o
+        SET next_attempt_at = CURRENT_TIMESTAMP + make_interval(secs => lease_seconds_input)
+        WHERE o.message_id IN (
+            SELECT message_id
+            FROM state_manager.chat_outbox_table
+            WHERE status = 'PENDING'
+              AND next_attempt_at <= CURRENT_TIMESTAMP
+            ORDER BY next_attempt_at, message_id
+            LIMIT limit_input
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING o.*
+    )
+    SELECT json_agg(row_to_json(t))
+    INTO result_json
+    FROM (
+        SELECT
+            c.message_id AS "messageId",
+            c.channel_id AS "channelId",
+            ch.kind,
+            ch.url,
+            c.event_name AS "eventName",
+            c.message,
+            c.attempts
+        FROM claimed c
+        JOIN state_manager.role_chat_channel_table ch ON ch.channel_id = c.channel_id
+        ORDER BY c.message_id
+    ) t;
+
+    IF result_json IS NULL THEN
+        result_json := '[]'::json;
+    END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Records a posting attempt. Without an error the message is SENT, otherwise it is retried in
+-- retry_seconds_input, or DEAD when that is NULL.
+CREATE OR REPLACE PROCEDURE state_manager.record_chat_attempt(
+    message_id_input    BIGINT,
+    error_input         TEXT,
+    retry_seconds_input INT
+) AS $$
+BEGIN
+    UPDATE state_manager.chat_outbox_table
+    SET attempts = attempts + 1,
+        status = CASE
+            WHEN error_input IS NULL THEN 'SENT'
+            WHEN retry_seconds_input IS NULL THEN 'DEAD'
+            ELSE 'PENDING'
+        END,
+        last_error = error_input,
+        next_attempt_at = COALESCE(CURRENT_TIMESTAMP + make_interval(secs => retry_seconds_input), next_attempt_at),
+        sent_at = CASE WHEN error_input IS NULL THEN CURRENT_TIMESTAMP END
+    WHERE message_id = message_id_input;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Lists every chat channel for the admin page.
+CREATE OR REPLACE FUNCTION state_manager.get_chat_channels(
+    user_id_input INT
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    CALL state_manager.assert_user_role(user_id_input, ARRAY[4]);
+
+    SELECT json_agg(row_to_json(t))
+    INTO result_json
+    FROM (
+        SELECT
+            ch.channel_id AS "channelId",
+            ch.role_id AS "roleId",
+            ch.kind,
+            ch.url,
+            ch.locale,
+            ch.created_at AS "createdAt",
+            (
+                SELECT COUNT(*)
+                FROM state_manager.chat_outbox_table o
+                WHERE o.channel_id = ch.channel_id
+                  AND (o.status = 'DEAD' OR (o.status = 'PENDING' AND o.attempts > 0))
+            ) AS "failedMessages"
+        FROM state_manager.role_chat_channel_table ch
+        ORDER BY ch.role_id, ch.channel_id
+    ) t;
+
+    IF result_json IS NULL THEN
+        result_json := '[]'::json;
+    END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Returns the kind, URL and locale of a chat channel, so an admin can post a test message to it.
+CREATE OR REPLACE FUNCTION state_manager.get_chat_channel(
+    user_id_input    INT,
+    channel_id_input INT
+)
+RETURNS JSON AS $$
+DECLARE
+    result_json JSON;
+BEGIN
+    CALL state_manager.assert_user_role(user_id_input, ARRAY[4]);
+
+    SELECT row_to_json(t)
+    INTO result_json
+    FROM (
+        SELECT
+            channel_id AS "channelId",
+            role_id AS "roleId",
+            kind,
+            url,
+            locale
+        FROM state_manager.role_chat_channel_table
+        WHERE channel_id = channel_id_input
+    ) t;
+
+    IF result_json IS NULL THEN
+        RAISE EXCEPTION 'Chat channel % does not exist', channel_id_input;
+    END IF;
+    RETURN result_json;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Adds a chat channel to a role and returns its ID. Only admins may change chat channels.
+CREATE OR REPLACE FUNCTION state_manager.create_chat_channel(
+    user_id_input INT,
+    role_id_input INT,
+    kind_input    VARCHAR,
+    url_input     TEXT,
+    locale_input  VARCHAR
+)
+RETURNS INT AS $$
+DECLARE
+    temp_channel_id INT;
+BEGIN
+    CALL state_manager.assert_user_role(user_id_input, ARRAY[4]);
+
+    INSERT INTO state_manager.role_chat_channel_table(role_id, kind, url, locale, created_by)
+    VALUES (role_id_input, kind_input, url_input, locale_input, user_id_input)
+    RETURNING channel_id INTO temp_channel_id;
+
+    RETURN temp_channel_id;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Removes a chat channel together with its queued messages. Only admins may change chat channels.
+CREATE OR REPLACE PROCEDURE state_manager.delete_chat_channel(
+    user_id_input    INT,
+    channel_id_input INT
+) AS $$
+BEGIN
+    CALL state_manager.assert_user_role(user_id_input, ARRAY[4]);
+
+    DELETE FROM state_manager.role_chat_channel_table
+    WHERE channel_id = channel_id_input;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Delete failed: chat channel % does not exist', channel_id_input;
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- TEST TO GET USER ID FROM CREDENTIAL CHECK
+SELECT get_user_id_by_credentials('Alto', '1234')
+
+-- CLEAR DATA WITHIN TABLE
+TRUNCATE TABLE state_table, requirement_table, attachment_table, request_table, user_role_table, user_table RESTART IDENTITY;
+
+TRUNCATE TABLE user_table;
+
+-- TRUNCATE TABLE requirement_type_table;
+-- TRUNCATE TABLE requirement_question_table;
+
+-- INSERT MAPPING OF STATE NAME AND ID
+INSERT INTO state_name_table (state_name_id, state_name)
+VALUES
+(0, 'REJECTED'),
+(1, 'SUBMITTED'),
+(2, 'VALIDATED'),
+(3, 'IN PROGRESS'),
+(4, 'WAITING FOR REVIEW'),
+(5, 'DONE'),
+(41, 'APPROVAL REJECTED');
+
+-- INSERT ROLE DATA
+INSERT INTO role_table (role_id, role_name)
+VALUES 
+(1, 'user'),
+(2, 'worker'),
+(3, 'validator'),
+(4, 'admin')
+
+-- INSERT DUMMY USER ROLE
+INSERT INTO user_role_table (user_id, role_id) VALUES
+(1, 1),
+(2, 1),
+(3, 1),
+(4, 1),
+(5, 1),
+(6, 1),
+(7, 2),
+(8, 2),
+(9, 3),
+(10, 3),
+(11, 3);
+
+-- INSERT DUMMY USER
+INSERT INTO state_manager.user_table (user_id, user_name, user_password, email, nik, position, department) VALUES
+-- ('1', 'alice',   '1234', 'alice@example.com',   1001, 'Manager',      'HR'),
+('2', 'ivan',    '1234', 'ivan@example.com',    1009, 'Supervisor',   'IT'),
+('3', 'grace',   '1234', 'grace@example.com',   1007, 'Manager',      'Marketing');
+,
+-- ('heidi',   '1234', 2, 'heidi@example.com',   1008, 'Staff',        'Marketing'),
+-- ('judy',    '1234', 1, 'judy@example.com',    1010, 'Manager',      'Finance')
+-- ('bob',     '1234', 2, 'bob@example.com',     1002, 'Staff',        'Finance'),
+-- ('carol',   '1234', 3, 'carol@example.com',   1003, 'Supervisor',   'IT'),
+-- ('dave',    '1234', 1, 'dave@example.com',    1004, 'Manager',      'IT'),
+-- ('eve',     '1234', 2, 'eve@example.com',     1005, 'Staff',        'HR'),
+-- ('frank',   '1234', 3, 'frank@example.com',   1006, 'Supervisor',   'Finance'),;
+
+INSERT INTO user_table (user_name, user_password, user_role, email, nik, position, department) VALUES
+('barta',    '1234', 1, 'barta@example.com',    1011, 'Manager',      'Finance');
+
+-- insert dummy request
+
+CALL create_new_request('Sales Report Q1', 1, 'alice', 'Analyze Q1 sales trends, focusing on regional performance.', '2025-01-20 17:00:00', 'alice', false, 1,
+ARRAY['CRM System A', 'Last Quarter', 'Revenue per Region'], 'Initial sales overview request');
+CALL create_new_request('Inventory Audit', 2, 'bob', 'Check inventory discrepancies across warehouses, needing specific new columns.', '2025-02-15 17:00:00', 'bob', true, 2,
+ARRAY['Warehouse Logs', 'Item_Quantity, Bin_Location', 'LIFO Method', 'false'], 'Urgent audit, data needed by end of week');
+CALL create_new_request('Customer Feedback', 3, 'carol', 'Summarize customer feedback from surveys and support tickets.', '2025-03-10 17:00:00', 'carol', false, 3,
+ARRAY['User Behavior Module', 'Website Analytics DB', 'Last 30 Days', 'Clickstream Analysis', 'Product Team', 'Heatmap Report'], 'Needs to be presented at quarterly review');
+CALL create_new_request('IT Upgrade', 4, 'dave', 'Plan for new hardware rollout in Q3.', '2025-03-25 17:00:00', 'dave', true, 1,
+ARRAY['Network Logs', 'Current Year', 'Bandwidth Usage'], 'High priority, budget allocation pending');
+CALL create_new_request('HR Survey', 5, 'eve', 'Analyze employee satisfaction scores from recent survey.', '2025-04-10 17:00:00', 'eve', false, 2,
+ARRAY['Employee Records DB', 'Job_Satisfaction_Index, Turnover_Rate', 'Standard Deviation', 'true'], 'Annual survey results analysis');
+CALL create_new_request('Budget Review', 6, 'frank', 'Review Q2 budget allocations and spending patterns.', '2025-04-30 17:00:00', 'frank', false, 3,
+ARRAY['Expense Tracking System', 'Financial GL', 'Q2 Current', 'Cost Center Allocation', 'Accounting Department', 'Expense Summary Report'], 'Prepare for monthly finance meeting');
+CALL create_new_request('Marketing Plan', 7, 'grace', 'Draft new marketing strategy for product launch.', '2025-05-15 17:00:00', 'grace', true, 1,
+ARRAY['Competitor Analysis', 'Next Quarter', 'Market Penetration'], 'Launch critical, needs quick turnaround');
+CALL create_new_request('Security Audit', 8, 'heidi', 'Assess system vulnerabilities and compliance.', '2025-05-28 17:00:00', 'heidi', false, 2,
+ARRAY['Vulnerability Scanner', 'Scan_Result_ID, Critical_Vulnerability_Count', 'CVSS Score', 'false'], 'Annual security review');
+CALL create_new_request('Supplier Evaluation', 9, 'ivan', 'Evaluate new suppliers for cost efficiency and quality.', '2025-06-11 17:00:00', 'ivan', true, 3,
+ARRAY['Vendor Portal', 'Contract Database', 'All Time', 'Quality Metrics', 'Purchasing Team', 'Supplier Risk Matrix'], 'Urgent to onboard new vendors');
+CALL create_new_request('Website Redesign', 10, 'judy', 'Plan new website layout and user experience improvements.', '2025-06-25 17:00:00', 'judy', false, 1,
+ARRAY['A/B Test Results', 'Current Version', 'Conversion Rate'], 'Enhance user engagement');
+CALL create_new_request('Inventory Audit (Q2)', 1, 'alice', 'Check inventory discrepancies for Q2 report.', '2025-02-15 17:00:00', 'alice', true, 2,
+ARRAY['Physical Count Sheet', 'Damaged_Items, Expired_Goods', 'Weighted Average', 'true'], 'Follow-up audit, Q2 data');
+
+-- SET RANDOM MONTH
+-- UPDATE request_table
+-- SET
+--     request_date = (
+--         -- Take the year from the original date
+--         EXTRACT(YEAR FROM request_date) || '-' ||
+--         -- Generate a random month (1-6) and format it with leading zero if needed
+--         LPAD(((FLOOR(RANDOM() * 6) + 1)::TEXT), 2, '0') || '-' ||
+--         -- Take the day from the original date and format it with leading zero if needed
+--         LPAD(EXTRACT(DAY FROM request_date)::TEXT, 2, '0') ||
+--         -- Append the time component from the original date
+--         TO_CHAR(request_date, ' HH24:MI:SS.MS')
+--     )::TIMESTAMP
+-- WHERE
+--     request_id BETWEEN 2 AND 10;
+
+UPDATE state_table
+SET date_start = request_table.request_date
+FROM request_table
+WHERE state_table.request_id = request_table.request_id
+  AND state_table.state_name_id = 1;
+
+-- INSERT REQUIREMENT QUESTIONS
 INSERT INTO requirement_question_table(requirement_question_id, requirement_question, requirement_type_id)
 VALUES
 -- FRRA Questions (Type 1)
@@ -930,6 +5629,9 @@ VALUES
 (2,'Dataset (Penambahan Column)',4),
 (3, 'Dataset baru',6)
 
+-- ASSIGN THE SEEDED QUESTIONS TO THE FIRST QUESTIONNAIRE VERSION OF THEIR TYPE
+CALL state_manager.migrate_questionnaire_versions();
+
 INSERT INTO attachment_type_table 
 VALUES
 (1,'docx/pdf'),
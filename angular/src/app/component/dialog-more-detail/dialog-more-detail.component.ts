@@ -2,7 +2,6 @@ import { Component, HostListener, inject, signal } from "@angular/core";
 import type {
 	AttachmentFilename,
 	CompleteData,
-	EmailRoleRecipient,
 	Question,
 	UpdateState,
 } from "../../model/format.type";
@@ -115,15 +114,8 @@ export class DialogMoreDetailComponent {
 				if (change === "drop") {
 					this.dataService.dropRequest(this.stateUpdateData).subscribe({
 						next: () => {
-							// On success, send email notification to the user which the request belong to
-							// with the reason of rejection
-							this.dataService
-								.postReminderEmail({
-									userId: this.data().userId,
-									comment: result,
-								})
-								.subscribe();
-							// Open a dialog to notify the user that the request has been succesfully updated
+							// On success the backend emails the owner of the request the reason of rejection,
+							// open a dialog to notify the user that the request has been succesfully updated
 							const reportDialogRef = this.reportService.openReportDialog(
 								"Successfully updated state.",
 								"success",
@@ -144,19 +136,8 @@ export class DialogMoreDetailComponent {
 				} else {
 					this.dataService.upgradeState(this.stateUpdateData).subscribe({
 						next: () => {
-							// On success, first check to whom to
-							// send email notification for the new request state
-							const targetRole = this.checkEmailRoleTarget(
-								this.data().stateName,
-							);
-							// If there is a target, send reminder
-							// (would not send for done, as email is sent by team upon done)
-							if (targetRole !== null) {
-								this.dataService
-									.postReminderEmailToRole(targetRole)
-									.subscribe();
-							}
-							// Pen dialog to notify use that the update was a success
+							// On success the backend notifies the users responsible for the new request state,
+							// open a dialog to notify the user that the update was a success
 							const reportDialogRef = this.reportService.openReportDialog(
 								"Successfully updated state.",
 								"success",
@@ -179,24 +160,6 @@ export class DialogMoreDetailComponent {
 		});
 	}
 
-	// Function to check the target of the email, would always send the
-	// email to the users responsible for the new state,
-	// Would not send for the new request of done (send null)
-	// because email is sent directly to team
-	checkEmailRoleTarget(stateName: string): EmailRoleRecipient | null {
-		console.log(`check with: ${stateName}`);
-		if (stateName === "SUBMITTED") {
-			return { roleId: 2, stateName: "VALIDATED" };
-		}
-		if (stateName === "VALIDATED") {
-			return { roleId: 2, stateName: "IN PROGRESS" };
-		}
-		if (stateName === "IN PROGRESS") {
-			return { roleId: 3, stateName: "WAITING FOR REVIEW" };
-		}
-		return null;
-	}
-
 	// Checks if the current page is the todo page.
 	// This is used to determine which buttons should be displayed.
 	checkPage() {
@@ -75,7 +75,7 @@ export class DialogNewRequestQuestionnaireComponent {
 		urgent: null,
 		requirementType: null,
 		remark: "",
-		answers: [],
+		answers: {},
 		docxAttachment: null,
 		docxFilename: null,
 		excelAttachment: null,
@@ -114,8 +114,10 @@ export class DialogNewRequestQuestionnaireComponent {
 			// Populate user-specific data from the service.
 			this.data.userId = Number(this.dataService.getUserId());
 			this.data.requesterName = this.dataService.getUserName();
-			// Collect all answers of the requirement questions.
-			this.data.answers = this.questions().map((q) => q.answer);
+			// Collect all answers of the requirement questions, keyed by question ID.
+			this.data.answers = Object.fromEntries(
+				this.questions().map((q) => [q.requirementQuestionId, q.answer]),
+			);
 
 			// Set UI state to show the upload progress indicator.
 			this.isUploading.set(true);
@@ -143,13 +145,8 @@ export class DialogNewRequestQuestionnaireComponent {
 						);
 						// Subscribe to report dialog close
 						dialogRefReport.afterClosed().subscribe(() => {
-							// Close the new request dialog along with the report dialog						const dialogRefReport = this.openReportDialog(
-							this.dataService
-								.postReminderEmailToRole({
-									roleId: 3,
-									stateName: "SUBMITTED",
-								})
-								.subscribe();
+							// Close the new request dialog along with the report dialog
+							// The backend notifies the validators of the new request
 							this.dialogRef.close("1");
 						});
 					}
@@ -0,0 +1,22 @@
+import { type ComponentFixture, TestBed } from "@angular/core/testing";
+
+import { ViewPickerComponent } from "./view-picker.component";
+
+describe("ViewPickerComponent", () => {
+	let component: ViewPickerComponent;
+	let fixture: ComponentFixture<ViewPickerComponent>;
+
+	beforeEach(async () => {
+		await TestBed.configureTestingModule({
+			imports: [ViewPickerComponent],
+		}).compileComponents();
+
+		fixture = TestBed.createComponent(ViewPickerComponent);
+		component = fixture.componentInstance;
+		fixture.detectChanges();
+	});
+
+	it("should create", () => {
+		expect(component).toBeTruthy();
+	});
+});
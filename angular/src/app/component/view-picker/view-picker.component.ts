@@ -0,0 +1,46 @@
+import {
+	Component,
+	EventEmitter,
+	inject,
+	Input,
+	Output,
+	signal,
+} from "@angular/core";
+import { MatFormFieldModule } from "@angular/material/form-field";
+import { MatSelectModule } from "@angular/material/select";
+import { FormsModule } from "@angular/forms";
+import type { SavedView } from "../../model/format.type";
+import { DataProcessingService } from "../../service/data-processing.service";
+
+@Component({
+	selector: "app-view-picker",
+	standalone: true,
+	imports: [MatFormFieldModule, MatSelectModule, FormsModule],
+	templateUrl: "./view-picker.component.html",
+	styleUrl: "./view-picker.component.css",
+})
+export class ViewPickerComponent {
+	// Injects necessary services.
+	dataService = inject(DataProcessingService);
+
+	// The currently loaded saved view, null for the page's default listing.
+	@Input() viewId: number | null = null;
+	// Notifies the parent page when the user loads another view.
+	@Output() viewSelected = new EventEmitter<number | null>();
+
+	// The saved views the user owns or that are shared with their role.
+	savedViews = signal<Array<SavedView>>([]);
+
+	ngOnInit() {
+		// Fetch the views the user can load.
+		this.dataService.getSavedViews().subscribe((result) => {
+			this.savedViews.set(result);
+		});
+	}
+
+	// Handles the user's selection, emitting the chosen view to the parent page.
+	selectView(viewId: number | null) {
+		this.viewId = viewId;
+		this.viewSelected.emit(viewId);
+	}
+}
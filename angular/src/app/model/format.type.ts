@@ -12,6 +12,7 @@ export type User = {
 	userId: string;
 	userName: string;
 	email: string;
+	locale: string;
 	roleId: string;
 };
 
@@ -98,7 +99,8 @@ export type NewRequest = {
 	picRequest: string;
 	urgent: boolean | null;
 	requirementType: number | null;
-	answers: string[] | null;
+	// Answers keyed by requirementQuestionId.
+	answers: Record<number, string> | null;
 	remark: string | null;
 	docxAttachment: File | null;
 	docxFilename: string | null;
@@ -168,16 +170,99 @@ export type Duration = {
 	hour: number;
 };
 
-// A type for the email notification to a specific user
-// Used on more details when rejecting a request
-export type EmailRecipient = {
-	userId: number;
-	comment: string;
+// The response of a successful request submission
+// Used by the new request dialog
+export type SubmittedRequest = {
+	message: string;
+	requestId: number;
 };
 
-// A type for the email notification to every user in a role
-// Used on more details when upgrading a request state
-export type EmailRoleRecipient = {
-	roleId: number;
-	stateName: string;
+// The filters and sort order of a request listing.
+// Used as the filter of a saved view, every field is optional.
+export type RequestFilter = {
+	stateIds?: number[];
+	stateEntry?: number;
+	requirementTypeIds?: number[];
+	requesterId?: number;
+	assigneeId?: number;
+	urgent?: boolean;
+	from?: string;
+	to?: string;
+	minHoursInState?: number;
+	sort?:
+		| "requestDate"
+		| "requestedFinishDate"
+		| "timeInState"
+		| "urgency"
+		| "state";
+	order?: "asc" | "desc";
+};
+
+// A named request filter, private to its owner or shared with a role.
+// Used to load a view on the todo and progress pages.
+export type SavedView = {
+	viewId: number;
+	viewName: string;
+	filter: RequestFilter;
+	sharedRoleId: number | null;
+	ownerId: number;
+	ownerName: string;
+	owned: boolean;
+};
+
+// A page of a request listing.
+// nextCursor is empty on the last page.
+export type RequestPage<T> = {
+	total: number;
+	items: T[];
+	nextCursor: string;
+};
+
+// How the user receives the emails of a notification event.
+// DIGEST leaves them to the daily summary email.
+export type NotificationPreference = {
+	eventName: string;
+	delivery: "IMMEDIATE" | "DIGEST" | "OFF";
+};
+
+// An in-app notification of something that happened to a request the user is concerned with.
+// eventName is a transition name, or COMMENTED, MENTIONED or ASSIGNED.
+// Used in pages of notifications (see NotificationPage below).
+export type AppNotification = {
+	notificationId: number;
+	eventName: string;
+	requestId: number | null;
+	requestTitle: string | null;
+	actorId: number | null;
+	actorName: string | null;
+	body: string | null;
+	createdAt: Date;
+	read: boolean;
+};
+
+// A page of in-app notifications, newest first.
+// nextCursor is null on the last page.
+export type NotificationPage = {
+	items: AppNotification[];
+	nextCursor: number | null;
+};
+
+// A change to a request pushed over the event stream (see RequestEventService).
+// The optional fields are only set for the event types they describe.
+// A "resync" event carries no request, it asks for the data to be reloaded after missed events.
+export type RequestEvent = {
+	type:
+		| "request-created"
+		| "state-changed"
+		| "comment-added"
+		| "assignment"
+		| "resync";
+	eventId?: number;
+	requestId?: number;
+	requesterId?: number;
+	stateId?: number;
+	previousStateId?: number;
+	assigneeId?: number;
+	commentId?: number;
+	internal?: boolean;
 };
@@ -14,6 +14,7 @@ import { MatDialog } from "@angular/material/dialog";
 import { DialogNewRequestQuestionnaireComponent } from "../../component/dialog-new-request-questionnaire/dialog-new-request-questionnaire.component";
 import { Router } from "@angular/router";
 import { TickCounterService } from "../../service/tick-counter.service";
+import { RequestEventService } from "../../service/request-event.service";
 
 @Component({
 	selector: "app-dashboard-page",
@@ -27,6 +28,8 @@ export class DashboardPageComponent {
 	// Injecting to refresh data each hour
 	counterService = inject(TickCounterService);
 	injector = inject(Injector);
+	// Injecting to refresh data whenever a request changes
+	requestEventService = inject(RequestEventService);
 	// Injecting MatDialog for newRequest dialog
 	dialog = inject(MatDialog);
 	// Injecting Router to handle routing
@@ -39,6 +42,8 @@ export class DashboardPageComponent {
 	// A flag to check if this is the first init
 
 	newInit = true;
+	// A flag to check if this is the first run of the event effect
+	newEventInit = true;
 
 	// This listens for the browser's 'resize' event on the window object and updates accordingly.
 	@HostListener("window:resize", ["$event"])
@@ -66,6 +71,25 @@ export class DashboardPageComponent {
 			},
 			{ injector: this.injector },
 		);
+		// Listen for request changes pushed by the backend
+		this.requestEventService.connect();
+		// Watches `requestEventService.lastEvent()` to refresh data whenever a request changes
+		effect(
+			() => {
+				// Reading the signal from service.
+				const event = this.requestEventService.lastEvent();
+
+				// If this is the first initialization, do not refresh
+				if (this.newEventInit === true) {
+					this.newEventInit = false;
+					return;
+				}
+				if (event !== null) {
+					this.refreshRequests();
+				}
+			},
+			{ injector: this.injector },
+		);
 	}
 
 	// Handles submission of a new request by calling the newRequest dialog
@@ -1,4 +1,4 @@
-import { Component, HostListener, inject, signal } from "@angular/core";
+import { Component, effect, HostListener, inject, signal } from "@angular/core";
 import { CardProgressCountComponent } from "../../component/card-progress-count/card-progress-count.component";
 import type {
 	CachedProgressCardMemory,
@@ -8,7 +8,9 @@ import type {
 } from "../../model/format.type";
 import { CardStateDataComponent } from "../../component/card-state-data/card-state-data.component";
 import { PeriodPickerComponent } from "../../component/period-picker/period-picker.component";
+import { ViewPickerComponent } from "../../component/view-picker/view-picker.component";
 import { ProgressPageService } from "../../service/progress-page.service";
+import { RequestEventService } from "../../service/request-event.service";
 
 @Component({
 	selector: "app-progress-page",
@@ -17,6 +19,7 @@ import { ProgressPageService } from "../../service/progress-page.service";
 		CardProgressCountComponent,
 		CardStateDataComponent,
 		PeriodPickerComponent,
+		ViewPickerComponent,
 	],
 	templateUrl: "./progress-page.component.html",
 	styleUrl: "./progress-page.component.css",
@@ -24,6 +27,8 @@ import { ProgressPageService } from "../../service/progress-page.service";
 export class ProgressPageComponent {
 	// Injects necessary services
 	progressService = inject(ProgressPageService);
+	// Pushes request changes to refresh the progress data
+	requestEventService = inject(RequestEventService);
 
 	// A signal holding the array of request data currently visible in the detailed list.
 	visibleStateData = signal<Array<StateInfoData>>([]);
@@ -46,7 +51,29 @@ export class ProgressPageComponent {
 		this.innerWidth.set(window.innerWidth);
 	}
 
+	// A flag to check if this is the first run of the event effect
+	private newInit = true;
+
+	constructor() {
+		// Watches `requestEventService.lastEvent()` to refresh data whenever a request changes
+		effect(() => {
+			// Reading the signal from service.
+			const event = this.requestEventService.lastEvent();
+
+			// If this is the first initialization, do not refresh
+			if (this.newInit === true) {
+				this.newInit = false;
+				return;
+			}
+			if (event !== null) {
+				this.refreshData();
+			}
+		});
+	}
+
 	ngOnInit() {
+		// Listen for request changes pushed by the backend
+		this.requestEventService.connect();
 		// Checks if state data have been initialized
 		if (this.progressService.getHasStateData() === false) {
 			// Update and fetch if data is not initialized
@@ -64,7 +91,24 @@ export class ProgressPageComponent {
 
 	// Handles the event emitted from the period picker when the user selects a new time period.
 	periodUpdate(newPeriod: TimePeriod) {
-		// Calls the service to update the period to the new period.
+		this.refreshData();
+	}
+
+	// Handles the event emitted from the view picker when the user loads another saved view.
+	viewUpdate(viewId: number | null) {
+		this.progressService.viewId.set(viewId);
+		// Refetch the visible request cards from the newly loaded view.
+		if (this.isShrunk()) {
+			const cache = this.currentViewStatus();
+			this.progressService.getStateSpecificData(cache.stateId).subscribe(() => {
+				this.setVisibleStateDataSignal(cache.type);
+			});
+		}
+	}
+
+	// Refetches the data of the current period, keeping the state specific request cards in view.
+	refreshData() {
+		// Calls the service to update the period to the current period.
 		this.progressService.updatePeriodAndFetchData().subscribe(() => {
 			// If the currently state specific request cards are visible,
 			// change the current request filter accordingly
@@ -1,4 +1,4 @@
-import { Component, HostListener, inject, signal } from "@angular/core";
+import { Component, effect, HostListener, inject, signal } from "@angular/core";
 import { DataProcessingService } from "../../service/data-processing.service";
 import type { SimpleData, StateThreshold } from "../../model/format.type";
 import { CardRequestComponent } from "../../component/card-request/card-request.component";
@@ -7,6 +7,11 @@ import { MatSelectModule } from "@angular/material/select";
 import { CommonModule } from "@angular/common";
 import { FormsModule } from "@angular/forms";
 import { TodoPageService } from "../../service/todo-page.service";
+import { RequestEventService } from "../../service/request-event.service";
+import { ActivatedRoute } from "@angular/router";
+import { MatDialog } from "@angular/material/dialog";
+import { DialogMoreDetailComponent } from "../../component/dialog-more-detail/dialog-more-detail.component";
+import { ViewPickerComponent } from "../../component/view-picker/view-picker.component";
 
 @Component({
 	selector: "app-todo-page",
@@ -17,6 +22,7 @@ import { TodoPageService } from "../../service/todo-page.service";
 		MatSelectModule,
 		CommonModule,
 		FormsModule,
+		ViewPickerComponent,
 	],
 	templateUrl: "./todo-page.component.html",
 	styleUrl: "./todo-page.component.css",
@@ -25,6 +31,10 @@ export class TodoPageComponent {
 	// Injects necessary services
 	todoService = inject(TodoPageService);
 	dataService = inject(DataProcessingService);
+	route = inject(ActivatedRoute);
+	dialog = inject(MatDialog);
+	// Pushes request changes to refresh the todo data
+	requestEventService = inject(RequestEventService);
 
 	// A signal that holds the array of request data currently visible in the UI.
 	visibleTodo = signal<Array<SimpleData>>([]);
@@ -42,9 +52,57 @@ export class TodoPageComponent {
 		this.innerWidth.set(window.innerWidth);
 	}
 
+	// A flag to check if this is the first run of the event effect
+	private newInit = true;
+
+	constructor() {
+		// Watches `requestEventService.lastEvent()` to refresh data whenever a request changes
+		effect(() => {
+			// Reading the signal from service.
+			const event = this.requestEventService.lastEvent();
+
+			// If this is the first initialization, do not refresh
+			if (this.newInit === true) {
+				this.newInit = false;
+				return;
+			}
+			if (event !== null) {
+				this.refreshData();
+			}
+		});
+	}
+
 	ngOnInit() {
+		// Listen for request changes pushed by the backend
+		this.requestEventService.connect();
 		// Set the visible todos based on the default filters
 		this.setVisibleBasedOnFilter();
+		// Open the request an email linked to, if any
+		const requestId = Number(
+			this.route.snapshot.queryParamMap.get("requestId"),
+		);
+		if (requestId > 0) {
+			this.openRequest(requestId);
+		}
+	}
+
+	// Opens the more details dialog of a request, used for links in notification emails.
+	openRequest(requestId: number) {
+		const dialogRef = this.dialog.open(DialogMoreDetailComponent, {
+			autoFocus: false,
+			width: "90vw",
+			height: "90vh",
+			maxWidth: "90vw",
+			maxHeight: "fit-content",
+			panelClass: "custom-dialog-container",
+			data: { requestId: requestId },
+		});
+		// Refresh the todo data if the request was updated from the dialog.
+		dialogRef.afterClosed().subscribe((result) => {
+			if (result) {
+				this.refreshData();
+			}
+		});
 	}
 
 	// Sets the current menu tab and refreshes the visible data accordingly.
@@ -85,6 +143,12 @@ export class TodoPageComponent {
 		}
 	}
 
+	// Handles the event emitted from the view picker when the user loads another saved view.
+	viewUpdate(viewId: number | null) {
+		this.todoService.viewId.set(viewId);
+		this.refreshData();
+	}
+
 	// Triggers a data refresh by calling the todoService.
 	refreshData() {
 		// Call the service to fetch fresh data from the backend.
@@ -13,10 +13,14 @@ import type {
 	StateStatus,
 	StateThreshold,
 	Duration,
-	EmailRecipient,
-	EmailRoleRecipient,
+	RequestFilter,
+	RequestPage,
+	SavedView,
+	SubmittedRequest,
+	NotificationPreference,
+	NotificationPage,
 } from "../model/format.type";
-import { map, type Observable, of } from "rxjs";
+import { EMPTY, expand, map, type Observable, of, reduce, tap } from "rxjs";
 
 @Injectable({
 	providedIn: "root",
@@ -35,6 +39,7 @@ export class DataProcessingService {
 		localStorage.setItem("userId", u.userId);
 		localStorage.setItem("userName", u.userName);
 		localStorage.setItem("userEmail", u.email);
+		localStorage.setItem("userLocale", u.locale);
 		localStorage.setItem("userRole", u.roleId);
 	}
 
@@ -53,6 +58,64 @@ export class DataProcessingService {
 		return this.returnIfNotNull(localStorage.getItem("userEmail"));
 	}
 
+	// Retrieves the language of the current user's notifications from localStorage.
+	getUserLocale(): string {
+		return this.returnIfNotNull(localStorage.getItem("userLocale"));
+	}
+
+	// Sets the language the current user receives notifications in.
+	setUserLocale(locale: string) {
+		const url = `${this.host}/userLocale`;
+		return this.http
+			.put(url, { userId: Number(this.getUserId()), locale: locale })
+			.pipe(tap(() => localStorage.setItem("userLocale", locale)));
+	}
+
+	// Fetches a page of the current user's in-app notifications, newest first.
+	// Pass the nextCursor of the previous page to get the next one.
+	getNotifications(unreadOnly = false, cursor: number | null = null) {
+		let url = `${this.host}/notifications?userId=${this.getUserId()}&unread=${unreadOnly}`;
+		if (cursor !== null) {
+			url += `&cursor=${cursor}`;
+		}
+		return this.http.get<NotificationPage>(url);
+	}
+
+	// Fetches the number of unread in-app notifications, cheap enough to poll.
+	getUnreadNotificationCount() {
+		const url = `${this.host}/notifications/unreadCount?userId=${this.getUserId()}`;
+		return this.http
+			.get<{ unread: number }>(url)
+			.pipe(map((response) => response.unread));
+	}
+
+	// Marks one of the current user's in-app notifications as read.
+	markNotificationRead(notificationId: number) {
+		const url = `${this.host}/notifications/${notificationId}/read`;
+		return this.http.put(url, { userId: Number(this.getUserId()) });
+	}
+
+	// Marks all of the current user's in-app notifications as read.
+	markAllNotificationsRead() {
+		const url = `${this.host}/notifications/readAll`;
+		return this.http.put(url, { userId: Number(this.getUserId()) });
+	}
+
+	// Fetches how the current user receives the emails of every notification event.
+	getNotificationPreferences() {
+		const url = `${this.host}/notificationPreferences?userId=${this.getUserId()}`;
+		return this.http.get<NotificationPreference[]>(url);
+	}
+
+	// Sets how the current user receives the emails of a notification event.
+	setNotificationPreference(preference: NotificationPreference) {
+		const url = `${this.host}/notificationPreferences`;
+		return this.http.put(url, {
+			userId: Number(this.getUserId()),
+			...preference,
+		});
+	}
+
 	// Retrieves the current user's role ID from localStorage.
 	getUserRole(): string {
 		return this.returnIfNotNull(localStorage.getItem("userRole"));
@@ -62,6 +125,7 @@ export class DataProcessingService {
 		localStorage.setItem("userId", "0");
 		localStorage.setItem("userName", "");
 		localStorage.setItem("userEmail", "");
+		localStorage.setItem("userLocale", "");
 		localStorage.setItem("userRole", "");
 	}
 
@@ -124,10 +188,69 @@ export class DataProcessingService {
 		return this.http.get<StateInfoData[]>(url);
 	}
 
+	// Fetches the saved views the user may load, their own and those shared with their role.
+	// Used to pick a view on the todo and progress pages
+	getSavedViews(): Observable<SavedView[]> {
+		const url = `${this.host}/views?userId=${this.getUserId()}`;
+		return this.http.get<SavedView[]>(url);
+	}
+
+	// Creates a saved view, or updates one of the user's own views when a view ID is given.
+	saveView(
+		viewName: string,
+		filter: RequestFilter,
+		sharedRoleId: number | null,
+		viewId?: number,
+	): Observable<SavedView> {
+		const body = {
+			userId: Number(this.getUserId()),
+			viewName: viewName,
+			filter: filter,
+			sharedRoleId: sharedRoleId ?? 0,
+		};
+		if (viewId !== undefined) {
+			return this.http.put<SavedView>(`${this.host}/views/${viewId}`, body);
+		}
+		return this.http.post<SavedView>(`${this.host}/views`, body);
+	}
+
+	// Deletes one of the user's own saved views.
+	deleteView(viewId: number) {
+		const url = `${this.host}/views/${viewId}?userId=${this.getUserId()}`;
+		return this.http.delete(url);
+	}
+
+	// Fetches a page of the requests matching a saved view.
+	// Used in place of the todo and progress data when a view is loaded
+	getViewRequests<T>(
+		viewId: number,
+		cursor?: string,
+	): Observable<RequestPage<T>> {
+		let url = `${this.host}/requests?userId=${this.getUserId()}&viewId=${viewId}&limit=200`;
+		if (cursor) {
+			url += `&cursor=${encodeURIComponent(cursor)}`;
+		}
+		return this.http.get<RequestPage<T>>(url);
+	}
+
+	// Fetches every page of a saved view's requests, following nextCursor until the last page.
+	// Used to load a saved view on the todo and progress pages.
+	getAllViewRequests<T>(viewId: number): Observable<T[]> {
+		return this.getViewRequests<T>(viewId).pipe(
+			expand((page) =>
+				page.nextCursor
+					? this.getViewRequests<T>(viewId, page.nextCursor)
+					: EMPTY,
+			),
+			reduce((items, page) => items.concat(page.items), [] as T[]),
+		);
+	}
+
 	// Fetches the complete, detailed data for a single request, including nested questions and file data (name and path).
-	// Used for detailed data display of a single request within more details
+	// Used for detailed data display of a single request within more details.
+	// Sends the user ID so reviewers also get the change history and internal comments.
 	getCompleteData(requestIdInput: number): Observable<CompleteData> {
-		const url = `${this.host}/completeRequestDataBundle?requestId=${requestIdInput}`;
+		const url = `${this.host}/completeRequestDataBundle?requestId=${requestIdInput}&userId=${this.getUserId()}`;
 		return this.http.get<CompleteData>(url);
 	}
 
@@ -234,7 +357,7 @@ export class DataProcessingService {
 			formData.append("excelAttachment", request.excelAttachment);
 
 		// Make the POST request with options to observe progress events.
-		return this.http.post(url, formData, {
+		return this.http.post<SubmittedRequest>(url, formData, {
 			reportProgress: true, // Tells HttpClient to emit upload progress events.
 			observe: "events", // Tells HttpClient to emit all events, not just the final response body.
 		});
@@ -260,19 +383,6 @@ export class DataProcessingService {
 		return this.http.put(url, stateUpdateData);
 	}
 
-	// Sends a request to the API to send a reminder email to a specific user
-	// Used on reject request (more details dialog)
-	postReminderEmail(emailRecipient: EmailRecipient) {
-		const url = `${this.host}/postReminderEmail`;
-		return this.http.post(url, emailRecipient);
-	}
-
-	// Sends a request to the API to send a reminder email to everyone in a specific role
-	// Used on upgrade request state (more details)
-	postReminderEmailToRole(emailRoleRecipient: EmailRoleRecipient) {
-		const url = `${this.host}/postReminderEmailToRole`;
-		return this.http.post(url, emailRoleRecipient);
-	}
 	// Calculates the time difference in total hours.
 	getTimeDifferenceInHour(dateRef: Date): number {
 		return Math.abs(Date.now() - new Date(dateRef).getTime()) / 3600000;
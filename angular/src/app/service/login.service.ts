@@ -7,6 +7,7 @@ import { Observable } from "rxjs";
 import { TodoPageService } from "./todo-page.service";
 import { PeriodPickerService } from "./period-picker.service";
 import { ProgressPageService } from "./progress-page.service";
+import { RequestEventService } from "./request-event.service";
 @Injectable({
 	providedIn: "root",
 })
@@ -18,6 +19,7 @@ export class LoginService {
 	todoService = inject(TodoPageService);
 	progressService = inject(ProgressPageService);
 	periodPickerService = inject(PeriodPickerService);
+	requestEventService = inject(RequestEventService);
 	host = "https://state-management-api.vercel.app/api";
 	// host = "http://localhost:9090/api";
 
@@ -70,6 +72,7 @@ export class LoginService {
 		this.periodPickerService.resetService();
 		this.todoService.resetService();
 		this.progressService.resetService();
+		this.requestEventService.resetService();
 		this.router.navigate([""]);
 	}
 }
@@ -29,6 +29,8 @@ export class ProgressPageService {
 	// A flag to check if this is a new init
 	private newInit = true;
 
+	// The saved view loaded in place of the state specific data, null for the default listing.
+	readonly viewId = signal<number | null>(null);
 	// A signal that holds the counts for each state (e.g., "SUBMITTED: 5 todo, 10 Done").
 	// Used to display the state count
 	readonly progressInfo = signal<Array<StatusInfo>>([]);
@@ -108,20 +110,24 @@ export class ProgressPageService {
 	getStateSpecificData(stateId: number): Observable<StateInfoData[]> {
 		// Clear any previously cached detailed data before fetching new data.
 		this.clearStateData();
-		// Fetch the requests data from the backend using getStateSpecificData() from dataService.
-		return this.dataService
-			.getStateSpecificData(
-				stateId,
-				this.currentPeriod.startDate.toISOString(),
-				this.currentPeriod.endDate.toISOString(),
-			)
-			.pipe(
-				// Use `tap` to cache the full result under the "TOTAL" key.
-				// This is the source data that will be used for client-side filtering.
-				tap((result) => {
-					this.stateData.set("TOTAL", result);
-				}),
-			);
+		// Fetch the requests data from the backend using getStateSpecificData() from dataService,
+		// or the requests of the saved view when one is loaded.
+		const viewId = this.viewId();
+		const stateData =
+			viewId === null
+				? this.dataService.getStateSpecificData(
+						stateId,
+						this.currentPeriod.startDate.toISOString(),
+						this.currentPeriod.endDate.toISOString(),
+					)
+				: this.dataService.getAllViewRequests<StateInfoData>(viewId);
+		return stateData.pipe(
+			// Use `tap` to cache the full result under the "TOTAL" key.
+			// This is the source data that will be used for client-side filtering.
+			tap((result) => {
+				this.stateData.set("TOTAL", result);
+			}),
+		);
 	}
 
 	// Retrieves a filtered list of requests (e.g., only "TODO" items) from the cache.
@@ -0,0 +1,16 @@
+import { TestBed } from '@angular/core/testing';
+
+import { RequestEventService } from './request-event.service';
+
+describe('RequestEventService', () => {
+  let service: RequestEventService;
+
+  beforeEach(() => {
+    TestBed.configureTestingModule({});
+    service = TestBed.inject(RequestEventService);
+  });
+
+  it('should be created', () => {
+    expect(service).toBeTruthy();
+  });
+});
@@ -0,0 +1,52 @@
+import { inject, Injectable, signal } from "@angular/core";
+import { DataProcessingService } from "./data-processing.service";
+import type { RequestEvent } from "../model/format.type";
+
+@Injectable({
+	providedIn: "root",
+})
+export class RequestEventService {
+	// Injects necessary services
+	private dataService = inject(DataProcessingService);
+
+	// The event types pushed by the backend's event stream.
+	// "resync" means events were missed and the data has to be reloaded.
+	private readonly eventTypes: Array<RequestEvent["type"]> = [
+		"request-created",
+		"state-changed",
+		"comment-added",
+		"assignment",
+		"resync",
+	];
+	// The open connection to the event stream, null while disconnected.
+	private source: EventSource | null = null;
+
+	// The latest request event received, null until the first one arrives.
+	// Pages watch this signal in an `effect` to refresh their data without a manual reload.
+	public readonly lastEvent = signal<RequestEvent | null>(null);
+
+	// Opens the event stream for the logged in user, if it is not already open.
+	// The browser reconnects on its own when the connection drops, sending the ID of the
+	// last event it got so the backend can replay the ones missed in between.
+	connect() {
+		const userId = this.dataService.getUserId();
+		if (this.source !== null || userId === "") {
+			return;
+		}
+		this.source = new EventSource(
+			`${this.dataService.host}/events?userId=${userId}`,
+		);
+		for (const type of this.eventTypes) {
+			this.source.addEventListener(type, (event: MessageEvent) => {
+				this.lastEvent.set(JSON.parse(event.data));
+			});
+		}
+	}
+
+	// Closes the event stream, used upon logout
+	resetService() {
+		this.source?.close();
+		this.source = null;
+		this.lastEvent.set(null);
+	}
+}
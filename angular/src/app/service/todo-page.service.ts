@@ -24,6 +24,8 @@ export class TodoPageService {
 			["DONE", []],
 		]),
 	);
+	// The saved view loaded in place of the role's todo data, null for the default todo list.
+	public readonly viewId = signal<number | null>(null);
 	// Data of the time treshold for each state until a visual warning will be displayed
 	public readonly todoStateThreshold = signal<Array<StateThreshold>>([]);
 
@@ -71,9 +73,14 @@ export class TodoPageService {
 	}
 
 	// Fetch new todo data from backend.
-	// Using getTodoData() from dataService
+	// Using getTodoData() from dataService, or getAllViewRequests() when a saved view is loaded
 	refreshTodoData(): Observable<SimpleData[]> {
-		return this.dataService.getTodoData().pipe(
+		const viewId = this.viewId();
+		const todoData =
+			viewId === null
+				? this.dataService.getTodoData()
+				: this.dataService.getAllViewRequests<SimpleData>(viewId);
+		return todoData.pipe(
 			tap((result) => {
 				// Then separated to the set categories
 				this.todoMap().set("TODO", this.separateTodo(result));
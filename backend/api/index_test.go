@@ -0,0 +1,612 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestComposeMail(t *testing.T) {
+	msg := MailMessage{
+		To:       []string{"a@example.com", "b@example.com"},
+		Subject:  "[StateManager] New request",
+		TextBody: "plain body",
+		HtmlBody: "<p>html body</p>",
+	}
+	var buf bytes.Buffer
+	if _, err := composeMail("sender@example.com", "reply@example.com", msg).WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	raw := buf.String()
+	for _, want := range []string{
+		"From: sender@example.com",
+		"Reply-To: reply@example.com",
+		"To: a@example.com, b@example.com",
+		"Subject: [StateManager] New request",
+		"Content-Type: text/plain",
+		"plain body",
+		"Content-Type: text/html",
+		"<p>html body</p>",
+	} {
+		if !strings.Contains(raw, want) {
+			t.Errorf("composed mail is missing %q:\n%s", want, raw)
+		}
+	}
+}
+
+func TestComposeMailWithoutReplyTo(t *testing.T) {
+	var buf bytes.Buffer
+	msg := MailMessage{To: []string{"a@example.com"}, Subject: "s", TextBody: "t", HtmlBody: "h"}
+	if _, err := composeMail("sender@example.com", "", msg).WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	if strings.Contains(buf.String(), "Reply-To:") {
+		t.Errorf("composed mail has a Reply-To header without a reply-to address:\n%s", buf.String())
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	mailer := &FileMailer{Dir: dir, From: "sender@example.com"}
+	for _, subject := range []string{"first", "second"} {
+		msg := MailMessage{To: []string{"a@example.com"}, Subject: subject, TextBody: "t", HtmlBody: "h"}
+		if err := mailer.Send(msg); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+
+	delivered, err := os.ReadDir(filepath.Join(dir, "new"))
+	if err != nil {
+		t.Fatalf("read new: %v", err)
+	}
+	if len(delivered) != 2 {
+		t.Fatalf("got %d files in new, want 2", len(delivered))
+	}
+	pending, err := os.ReadDir(filepath.Join(dir, "tmp"))
+	if err != nil {
+		t.Fatalf("read tmp: %v", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("got %d files left in tmp, want 0", len(pending))
+	}
+	raw, err := os.ReadFile(filepath.Join(dir, "new", delivered[0].Name()))
+	if err != nil {
+		t.Fatalf("read message: %v", err)
+	}
+	if !strings.Contains(string(raw), "From: sender@example.com") {
+		t.Errorf("message is missing its sender:\n%s", raw)
+	}
+}
+
+func TestMemoryMailer(t *testing.T) {
+	mailer := &MemoryMailer{}
+	first := MailMessage{To: []string{"a@example.com"}, Subject: "first"}
+	second := MailMessage{To: []string{"b@example.com"}, Subject: "second"}
+	for _, msg := range []MailMessage{first, second} {
+		if err := mailer.Send(msg); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+
+	messages := mailer.Messages()
+	if len(messages) != 2 || messages[0].Subject != "first" || messages[1].Subject != "second" {
+		t.Fatalf("got %+v, want the first and second messages in order", messages)
+	}
+	// The returned slice is a copy.
+	messages[0].Subject = "changed"
+	if mailer.Messages()[0].Subject != "first" {
+		t.Errorf("changing the returned messages changed the recorded ones")
+	}
+
+	mailer.Reset()
+	if got := mailer.Messages(); len(got) != 0 {
+		t.Errorf("got %d messages after Reset, want 0", len(got))
+	}
+}
+
+// chatStub is a local incoming-webhook stub that records the payloads posted to it
+// and answers with status.
+type chatStub struct {
+	*httptest.Server
+	status   int
+	payloads [][]byte
+}
+
+func newChatStub(t *testing.T, status int) *chatStub {
+	stub := &chatStub{status: status}
+	stub.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %s with Content-Type %q, want a JSON POST", r.Method, r.Header.Get("Content-Type"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		stub.payloads = append(stub.payloads, body)
+		w.WriteHeader(stub.status)
+		fmt.Fprint(w, "stub reply")
+	}))
+	t.Cleanup(stub.Close)
+	return stub
+}
+
+// lastPayload decodes the last payload posted to the stub.
+func (s *chatStub) lastPayload(t *testing.T) map[string]any {
+	t.Helper()
+	if len(s.payloads) == 0 {
+		t.Fatal("nothing was posted")
+	}
+	var payload map[string]any
+	if err := json.Unmarshal(s.payloads[len(s.payloads)-1], &payload); err != nil {
+		t.Fatalf("payload is not JSON: %v\n%s", err, s.payloads[len(s.payloads)-1])
+	}
+	return payload
+}
+
+var sampleChatMessage = ChatMessage{
+	Title:    "[StateManager] New request: <b> & co (ID 1)",
+	Fields:   []ChatField{{Label: "Requester", Value: "Budi"}, {Label: "Comment", Value: "Ani: looks good @channel"}},
+	Link:     "https://example.com/home?requestId=1",
+	LinkText: "Open request",
+}
+
+func postToStub(t *testing.T, kind string, msg ChatMessage) *chatStub {
+	t.Helper()
+	stub := newChatStub(t, http.StatusOK)
+	channel, err := newChatChannel(kind, stub.URL)
+	if err != nil {
+		t.Fatalf("newChatChannel: %v", err)
+	}
+	if err := channel.Post(msg); err != nil {
+		t.Fatalf("Post: %v", err)
+	}
+	return stub
+}
+
+func TestSlackChannelPost(t *testing.T) {
+	msg := sampleChatMessage
+	msg.Fields = nil
+	for i := range 12 {
+		msg.Fields = append(msg.Fields, ChatField{Label: fmt.Sprintf("Label %d", i), Value: "a < b"})
+	}
+	payload := postToStub(t, "SLACK", msg).lastPayload(t)
+
+	if payload["text"] != msg.Title {
+		t.Errorf("got text %q, want the plain title", payload["text"])
+	}
+	blocks := payload["blocks"].([]any)
+	// The title, 10 fields, 2 fields and the button.
+	if len(blocks) != 4 {
+		t.Fatalf("got %d blocks, want 4: %v", len(blocks), blocks)
+	}
+	title := blocks[0].(map[string]any)["text"].(map[string]any)["text"]
+	want := "*<https://example.com/home?requestId=1|[StateManager] New request: &lt;b&gt; &amp; co (ID 1)>*"
+	if title != want {
+		t.Errorf("got title %q, want %q", title, want)
+	}
+	for i, count := range []int{10, 2} {
+		fields := blocks[i+1].(map[string]any)["fields"].([]any)
+		if len(fields) != count {
+			t.Errorf("got %d fields in section %d, want %d", len(fields), i+1, count)
+		}
+	}
+	field := blocks[1].(map[string]any)["fields"].([]any)[0].(map[string]any)["text"]
+	if field != "*Label 0*\na &lt; b" {
+		t.Errorf("got field %q, want the escaped label and value", field)
+	}
+	button := blocks[3].(map[string]any)["elements"].([]any)[0].(map[string]any)
+	if button["type"] != "button" || button["url"] != msg.Link {
+		t.Errorf("got %v, want a button to the request", button)
+	}
+}
+
+func TestTeamsChannelPost(t *testing.T) {
+	msg := sampleChatMessage
+	msg.Fields = append(slices.Clone(msg.Fields), ChatField{Label: "Comment", Value: "see [here](https://evil.example)\n# **now**"})
+	payload := postToStub(t, "TEAMS", msg).lastPayload(t)
+
+	if payload["type"] != "message" {
+		t.Errorf("got type %q, want message", payload["type"])
+	}
+	attachment := payload["attachments"].([]any)[0].(map[string]any)
+	if attachment["contentType"] != "application/vnd.microsoft.card.adaptive" {
+		t.Errorf("got content type %q, want an Adaptive Card", attachment["contentType"])
+	}
+	card := attachment["content"].(map[string]any)
+	if card["type"] != "AdaptiveCard" {
+		t.Errorf("got card type %q, want AdaptiveCard", card["type"])
+	}
+	body := card["body"].([]any)
+	if want := "\\[StateManager\\] New request: \\<b\\> & co \\(ID 1\\)"; body[0].(map[string]any)["text"] != want {
+		t.Errorf("got title %v, want %q", body[0], want)
+	}
+	facts := body[1].(map[string]any)["facts"].([]any)
+	if len(facts) != 3 || facts[0].(map[string]any)["title"] != "Requester" || facts[0].(map[string]any)["value"] != "Budi" {
+		t.Errorf("got facts %v, want the message's fields", facts)
+	}
+	if want := "see \\[here\\]\\(https://evil.example\\) \\# \\*\\*now\\*\\*"; facts[2].(map[string]any)["value"] != want {
+		t.Errorf("got fact value %q, want %q", facts[2].(map[string]any)["value"], want)
+	}
+	action := card["actions"].([]any)[0].(map[string]any)
+	if action["type"] != "Action.OpenUrl" || action["url"] != sampleChatMessage.Link || action["title"] != "Open request" {
+		t.Errorf("got action %v, want a link to the request", action)
+	}
+}
+
+func TestMattermostChannelPost(t *testing.T) {
+	msg := sampleChatMessage
+	msg.Fields = append(slices.Clone(msg.Fields), ChatField{Label: "Comment", Value: "see [here](https://evil.example)\n#### @all"})
+	text := postToStub(t, "MATTERMOST", msg).lastPayload(t)["text"].(string)
+
+	want := "#### [\\[StateManager\\] New request: \\<b\\> & co \\(ID 1\\)](https://example.com/home?requestId=1)\n" +
+		"**Requester:** Budi\n" +
+		"**Comment:** Ani: looks good @\u200bchannel\n" +
+		"**Comment:** see \\[here\\]\\(https://evil.example\\) \\#\\#\\#\\# @\u200ball\n"
+	if text != want {
+		t.Errorf("got text\n%q\nwant\n%q", text, want)
+	}
+}
+
+func TestPostChatJSONRefused(t *testing.T) {
+	for _, tc := range []struct {
+		status    int
+		permanent bool
+	}{
+		{http.StatusBadRequest, true},
+		{http.StatusNotFound, true},
+		{http.StatusGone, true},
+		{http.StatusRequestTimeout, false},
+		{http.StatusTooManyRequests, false},
+		{http.StatusInternalServerError, false},
+	} {
+		stub := newChatStub(t, tc.status)
+		err := postChatJSON(stub.URL, map[string]string{"text": "hi"})
+		var postErr *ChatPostError
+		if !errors.As(err, &postErr) {
+			t.Errorf("status %d: got %v, want a *ChatPostError", tc.status, err)
+			continue
+		}
+		if postErr.StatusCode != tc.status || postErr.Reason != "stub reply" {
+			t.Errorf("status %d: got %+v, want the status and reply of the stub", tc.status, postErr)
+		}
+		if postErr.Permanent() != tc.permanent {
+			t.Errorf("status %d: got permanent %v, want %v", tc.status, postErr.Permanent(), tc.permanent)
+		}
+	}
+}
+
+func TestPostChatJSONAccepted(t *testing.T) {
+	stub := newChatStub(t, http.StatusNoContent)
+	if err := postChatJSON(stub.URL, map[string]string{"text": "hi"}); err != nil {
+		t.Errorf("got %v for a 204, want no error", err)
+	}
+}
+
+func TestNewChatChannelUnknownKind(t *testing.T) {
+	if _, err := newChatChannel("IRC", "https://example.com"); err == nil {
+		t.Error("got no error for an unknown kind")
+	}
+}
+
+func TestWriteRequestEvent(t *testing.T) {
+	var buf bytes.Buffer
+	writeRequestEvent(&buf, RequestEvent{EventId: 42, Type: "state-changed", RequestId: 7, RequesterId: 3})
+	want := "id: 42\nevent: state-changed\ndata: {\"eventId\":42,\"type\":\"state-changed\",\"requestId\":7,\"requesterId\":3}\n\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestEventHubResyncsSlowSubscriber(t *testing.T) {
+	// Subscribers are added directly, since subscribe would start listening on the database.
+	fast := &eventSubscriber{events: make(chan RequestEvent, 2), resync: make(chan struct{}, 1)}
+	slow := &eventSubscriber{events: make(chan RequestEvent, 1), resync: make(chan struct{}, 1)}
+	hub := eventHub{subscribers: map[*eventSubscriber]struct{}{fast: {}, slow: {}}}
+
+	hub.broadcast(RequestEvent{EventId: 1})
+	hub.broadcast(RequestEvent{EventId: 2})
+
+	if len(fast.events) != 2 || len(fast.resync) != 0 {
+		t.Errorf("fast subscriber got %d events and %d resyncs, want 2 and 0", len(fast.events), len(fast.resync))
+	}
+	if len(slow.events) != 1 || len(slow.resync) != 1 {
+		t.Errorf("slow subscriber got %d events and %d resyncs, want 1 and 1", len(slow.events), len(slow.resync))
+	}
+}
+
+func TestRequestEventVisibleTo(t *testing.T) {
+	event := RequestEvent{RequesterId: 3}
+	internal := RequestEvent{RequesterId: 3, Internal: true}
+	switch {
+	case !event.visibleTo(3, false):
+		t.Error("requester cannot see an event of their own request")
+	case event.visibleTo(4, false):
+		t.Error("another requester can see the event")
+	case internal.visibleTo(3, false):
+		t.Error("requester can see an internal comment")
+	case !internal.visibleTo(4, true):
+		t.Error("staff cannot see an internal comment")
+	}
+}
+
+func TestSendWebhookSignsTimestampAndBody(t *testing.T) {
+	var header http.Header
+	var body []byte
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer stub.Close()
+
+	delivery := WebhookDelivery{DeliveryId: 5, URL: stub.URL, Secret: "s3cret", EventName: "DONE", Payload: `{"requestId":7}`}
+	if status, err := sendWebhook(delivery); err != nil || status != http.StatusOK {
+		t.Fatalf("got status %d and error %v, want 200 and no error", status, err)
+	}
+
+	timestamp := header.Get("X-Webhook-Timestamp")
+	if timestamp == "" {
+		t.Fatal("no X-Webhook-Timestamp header")
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(timestamp + "." + string(body)))
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); header.Get("X-Webhook-Signature") != want {
+		t.Errorf("got signature %q, want %q", header.Get("X-Webhook-Signature"), want)
+	}
+	if webhookSignature("s3cret", "1", string(body)) == webhookSignature("s3cret", "2", string(body)) {
+		t.Error("the signature does not depend on the timestamp")
+	}
+}
+
+func floatPtr(v float64) *float64 {
+	return &v
+}
+
+func TestValidateAnswer(t *testing.T) {
+	options := []string{"A", "B", "C"}
+	for _, tc := range []struct {
+		name     string
+		q        Question
+		answer   string
+		required bool
+		want     string
+	}{
+		{"empty optional", Question{QuestionType: "TEXT"}, "", false, ""},
+		{"empty required", Question{QuestionType: "TEXT"}, "", true, "an answer is required"},
+		{"number", Question{QuestionType: "NUMBER"}, "12.5", false, ""},
+		{"not a number", Question{QuestionType: "NUMBER"}, "twelve", false, "must be a number"},
+		{"number below min", Question{QuestionType: "NUMBER", MinValue: floatPtr(1)}, "0", false, "must be at least 1"},
+		{"number above max", Question{QuestionType: "NUMBER", MaxValue: floatPtr(10)}, "11", false, "must be at most 10"},
+		{"number on bounds", Question{QuestionType: "NUMBER", MinValue: floatPtr(1), MaxValue: floatPtr(10)}, "10", false, ""},
+		{"date", Question{QuestionType: "DATE"}, "2025-02-28", false, ""},
+		{"RFC 3339 date", Question{QuestionType: "DATE"}, "2025-02-28T10:00:00Z", false, ""},
+		{"not a date", Question{QuestionType: "DATE"}, "28/02/2025", false, "must be a date (YYYY-MM-DD)"},
+		{"yes", Question{QuestionType: "YES_NO"}, "true", false, ""},
+		{"not yes or no", Question{QuestionType: "YES_NO"}, "maybe", false, "must be true or false"},
+		{"single select", Question{QuestionType: "SINGLE_SELECT", Options: options}, "B", false, ""},
+		{"single select unknown option", Question{QuestionType: "SINGLE_SELECT", Options: options}, "D", false, "must be one of the listed options"},
+		{"multi select", Question{QuestionType: "MULTI_SELECT", Options: options}, `["A","C"]`, false, ""},
+		{"multi select not an array", Question{QuestionType: "MULTI_SELECT", Options: options}, "A", false, "must be a JSON array of options"},
+		{"multi select unknown option", Question{QuestionType: "MULTI_SELECT", Options: options}, `["A","D"]`, false, `"D" is not one of the listed options`},
+		{"multi select none required", Question{QuestionType: "MULTI_SELECT", Options: options}, "[]", true, "an answer is required"},
+		{"multi select too few", Question{QuestionType: "MULTI_SELECT", Options: options, MinValue: floatPtr(2)}, `["A"]`, false, "must be at least 2 choices"},
+		{"multi select too many", Question{QuestionType: "MULTI_SELECT", Options: options, MaxValue: floatPtr(2)}, `["A","B","C"]`, false, "must be at most 2 choices"},
+		{"text too short", Question{QuestionType: "TEXT", MinValue: floatPtr(3)}, "ab", false, "must be at least 3 characters"},
+		{"text length in runes", Question{QuestionType: "TEXT", MaxValue: floatPtr(3)}, "äöü", false, ""},
+		{"text too long", Question{QuestionType: "TEXT", MaxValue: floatPtr(3)}, "abcd", false, "must be at most 3 characters"},
+		{"pattern", Question{QuestionType: "TEXT", Pattern: `^[A-Z]{3}-\d+$`}, "ABC-12", false, ""},
+		{"pattern mismatch", Question{QuestionType: "TEXT", Pattern: `^[A-Z]{3}-\d+$`}, "abc-12", false, "does not match the expected format"},
+		{"invalid pattern ignored", Question{QuestionType: "TEXT", Pattern: "("}, "anything", false, ""},
+	} {
+		if got := validateAnswer(tc.q, tc.answer, tc.required); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestConditionsHold(t *testing.T) {
+	answers := map[int]string{1: "Yes", 2: `["A","B"]`, 3: "", 4: "[]"}
+	for _, tc := range []struct {
+		name       string
+		conditions []Condition
+		want       bool
+	}{
+		{"no conditions", nil, true},
+		{"equals", []Condition{{QuestionId: 1, Operator: "EQUALS", Value: "Yes"}}, true},
+		{"equals is case sensitive", []Condition{{QuestionId: 1, Operator: "EQUALS", Value: "yes"}}, false},
+		{"operator is case insensitive", []Condition{{QuestionId: 1, Operator: "equals", Value: "Yes"}}, true},
+		{"not equals", []Condition{{QuestionId: 1, Operator: "NOT_EQUALS", Value: "No"}}, true},
+		{"in", []Condition{{QuestionId: 1, Operator: "IN", Values: []string{"No", "Yes"}}}, true},
+		{"not in", []Condition{{QuestionId: 1, Operator: "IN", Values: []string{"No"}}}, false},
+		{"multi select equals any choice", []Condition{{QuestionId: 2, Operator: "EQUALS", Value: "B"}}, true},
+		{"multi select not equals a choice", []Condition{{QuestionId: 2, Operator: "NOT_EQUALS", Value: "A"}}, false},
+		{"multi select in", []Condition{{QuestionId: 2, Operator: "IN", Values: []string{"C", "A"}}}, true},
+		{"not empty", []Condition{{QuestionId: 1, Operator: "NOT_EMPTY"}}, true},
+		{"empty answer", []Condition{{QuestionId: 3, Operator: "NOT_EMPTY"}}, false},
+		{"no choices", []Condition{{QuestionId: 4, Operator: "NOT_EMPTY"}}, false},
+		{"unanswered question", []Condition{{QuestionId: 9, Operator: "NOT_EMPTY"}}, false},
+		{"unknown operator", []Condition{{QuestionId: 1, Operator: "LIKE", Value: "Yes"}}, false},
+		{"all must hold", []Condition{
+			{QuestionId: 1, Operator: "EQUALS", Value: "Yes"},
+			{QuestionId: 3, Operator: "NOT_EMPTY"},
+		}, false},
+	} {
+		if got := conditionsHold(tc.conditions, answers); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestResolveAnswers(t *testing.T) {
+	questions := []Question{
+		{RequirementQuestionId: 10, QuestionType: "YES_NO", Required: true},
+		{RequirementQuestionId: 11, QuestionType: "TEXT", VisibleWhen: []Condition{{QuestionId: 10, Operator: "EQUALS", Value: "true"}}},
+		{RequirementQuestionId: 12, QuestionType: "NUMBER", RequiredWhen: []Condition{{QuestionId: 11, Operator: "NOT_EMPTY"}}},
+	}
+	for _, tc := range []struct {
+		name       string
+		answers    AnswerSet
+		want       map[int]string
+		wantErrors []QuestionError
+	}{
+		{
+			name:    "visible and answered",
+			answers: AnswerSet{ById: map[int]string{10: "true", 11: " why ", 12: "3"}},
+			want:    map[int]string{10: "true", 11: "why", 12: "3"},
+		},
+		{
+			name:    "hidden answer blanked",
+			answers: AnswerSet{ById: map[int]string{10: "false", 11: "why", 12: "3"}},
+			want:    map[int]string{10: "false", 11: "", 12: "3"},
+		},
+		{
+			name:       "required missing",
+			answers:    AnswerSet{ById: map[int]string{}},
+			want:       map[int]string{10: "", 11: "", 12: ""},
+			wantErrors: []QuestionError{{RequirementQuestionId: 10, Message: "an answer is required"}},
+		},
+		{
+			name:       "required when a condition holds",
+			answers:    AnswerSet{ById: map[int]string{10: "true", 11: "why"}},
+			want:       map[int]string{10: "true", 11: "why", 12: ""},
+			wantErrors: []QuestionError{{RequirementQuestionId: 12, Message: "an answer is required"}},
+		},
+		{
+			name:    "hidden question counts as unanswered",
+			answers: AnswerSet{ById: map[int]string{10: "false", 11: "why"}},
+			want:    map[int]string{10: "false", 11: "", 12: ""},
+		},
+		{
+			name:    "unknown questions rejected",
+			answers: AnswerSet{ById: map[int]string{10: "true", 99: "x", 98: "y"}},
+			want:    map[int]string{10: "true", 11: "", 12: ""},
+			wantErrors: []QuestionError{
+				{RequirementQuestionId: 98, Message: "unknown question"},
+				{RequirementQuestionId: 99, Message: "unknown question"},
+			},
+		},
+		{
+			name:       "invalid answer",
+			answers:    AnswerSet{ById: map[int]string{10: "true", 12: "many"}},
+			want:       map[int]string{10: "true", 11: "", 12: "many"},
+			wantErrors: []QuestionError{{RequirementQuestionId: 12, Message: "must be a number"}},
+		},
+		{
+			name:    "positional",
+			answers: AnswerSet{Positional: []string{"true", "why"}},
+			want:    map[int]string{10: "true", 11: "why", 12: ""},
+			wantErrors: []QuestionError{
+				{RequirementQuestionId: 12, Message: "an answer is required"},
+			},
+		},
+		{
+			name:       "too many positional answers",
+			answers:    AnswerSet{Positional: []string{"false", "", "", "extra"}},
+			want:       map[int]string{10: "false", 11: "", 12: ""},
+			wantErrors: []QuestionError{{Message: "expected at most 3 answers, got 4"}},
+		},
+	} {
+		got, gotErrors := resolveAnswers(questions, tc.answers)
+		if got.Positional != nil || !maps.Equal(got.ById, tc.want) {
+			t.Errorf("%s: got answers %+v, want %v", tc.name, got, tc.want)
+		}
+		if !slices.Equal(gotErrors, tc.wantErrors) {
+			t.Errorf("%s: got errors %+v, want %+v", tc.name, gotErrors, tc.wantErrors)
+		}
+	}
+}
+
+func TestAnswerSetUnmarshalJSON(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		data    string
+		want    AnswerSet
+		wantErr bool
+	}{
+		{name: "keyed", data: `{"10":"yes","11":""}`, want: AnswerSet{ById: map[int]string{10: "yes", 11: ""}}},
+		{name: "positional", data: ` ["yes", ""]`, want: AnswerSet{Positional: []string{"yes", ""}}},
+		{name: "empty object", data: `{}`, want: AnswerSet{ById: map[int]string{}}},
+		{name: "null", data: `null`, want: AnswerSet{}},
+		{name: "non-numeric key", data: `{"first":"yes"}`, wantErr: true},
+		{name: "non-string answer", data: `[1, 2]`, wantErr: true},
+	} {
+		var got AnswerSet
+		err := json.Unmarshal([]byte(tc.data), &got)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tc.name, err, tc.wantErr)
+			continue
+		}
+		if tc.wantErr {
+			continue
+		}
+		if !maps.Equal(got.ById, tc.want.ById) || !slices.Equal(got.Positional, tc.want.Positional) ||
+			(got.ById == nil) != (tc.want.ById == nil) || (got.Positional == nil) != (tc.want.Positional == nil) {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+
+	// A decoded set replaces what the target held before.
+	set := AnswerSet{ById: map[int]string{1: "old"}}
+	if err := json.Unmarshal([]byte(`["new"]`), &set); err != nil || set.ById != nil {
+		t.Errorf("got %+v and error %v, want only the positional answers", set, err)
+	}
+}
+
+func TestNextRecurrence(t *testing.T) {
+	at := func(value string) time.Time {
+		parsed, err := time.Parse(time.DateTime, value)
+		if err != nil {
+			t.Fatalf("parse %q: %v", value, err)
+		}
+		return parsed
+	}
+	for _, tc := range []struct {
+		rule  string
+		after string
+		want  string
+	}{
+		{"DAILY", "2025-03-03 00:00:00", "2025-03-04 00:00:00"},
+		{"DAILY", "2025-03-03 23:59:00", "2025-03-04 00:00:00"},
+		{"WEEKLY:1", "2025-03-03 00:00:00", "2025-03-10 00:00:00"},
+		{"WEEKLY:7", "2025-03-03 09:00:00", "2025-03-09 00:00:00"},
+		{"MONTHLY:15", "2025-03-14 23:00:00", "2025-03-15 00:00:00"},
+		// Strictly after: a run at midnight of the day itself moves on to the next month.
+		{"MONTHLY:15", "2025-03-15 00:00:00", "2025-04-15 00:00:00"},
+		{"MONTHLY:31", "2025-01-31 00:00:00", "2025-02-28 00:00:00"},
+		{"MONTHLY:31", "2024-01-31 10:00:00", "2024-02-29 00:00:00"},
+		{"MONTHLY:31", "2025-02-28 00:00:00", "2025-03-31 00:00:00"},
+		{"MONTHLY:31", "2025-12-31 00:00:00", "2026-01-31 00:00:00"},
+		// 2025-03-01 is a Saturday and 2025-06-01 a Sunday.
+		{"FIRST_WORKING_DAY_MONTHLY", "2025-02-10 08:00:00", "2025-03-03 00:00:00"},
+		{"FIRST_WORKING_DAY_MONTHLY", "2025-03-01 00:00:00", "2025-03-03 00:00:00"},
+		{"FIRST_WORKING_DAY_MONTHLY", "2025-03-03 00:00:00", "2025-04-01 00:00:00"},
+		{"FIRST_WORKING_DAY_MONTHLY", "2025-05-20 00:00:00", "2025-06-02 00:00:00"},
+	} {
+		got, err := nextRecurrence(tc.rule, at(tc.after))
+		if err != nil {
+			t.Errorf("%s after %s: %v", tc.rule, tc.after, err)
+			continue
+		}
+		if want := at(tc.want); !got.Equal(want) {
+			t.Errorf("%s after %s: got %s, want %s", tc.rule, tc.after, got.Format(time.DateTime), tc.want)
+		}
+	}
+}
+
+func TestNextRecurrenceInvalidRule(t *testing.T) {
+	for _, rule := range []string{"WEEKLY:0", "WEEKLY:8", "MONTHLY:0", "MONTHLY:32", "MONTHLY:x", "YEARLY", ""} {
+		if _, err := nextRecurrence(rule, time.Now()); err == nil {
+			t.Errorf("%q: got no error", rule)
+		}
+	}
+}